@@ -0,0 +1,141 @@
+/*
+Package audit records administrative actions as audit records, separately
+from request logs. Records are written to a Sink: a zap logger, an
+append-only JSON lines file whose records are chained with a keyed HMAC so
+tampering can be detected, or a Redis stream.
+
+	sink, err := audit.OpenFileSink("/var/log/app/audit.jsonl", key)
+	if err != nil {
+		return err
+	}
+	handler = middlewares.Apply(handler, audit.Middleware(sink), middlewares.Authenticate(opts))
+
+Actions that aren't HTTP requests can be recorded directly:
+
+	audit.Log(ctx, sink, "user.delete", userID, audit.OutcomeSuccess, nil)
+*/
+package audit
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+)
+
+// Outcome is the result of an audited action
+type Outcome string
+
+// Outcomes of audited actions
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	OutcomeDenied  Outcome = "denied"
+)
+
+// Record describes one audited action
+type Record struct {
+	Time      time.Time         `json:"time"`
+	ActorID   string            `json:"actor_id"`
+	OrgID     string            `json:"org_id,omitempty"`
+	Admin     bool              `json:"admin"`
+	Action    string            `json:"action"`
+	Target    string            `json:"target"`
+	Outcome   Outcome           `json:"outcome"`
+	RequestID string            `json:"request_id,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	// PrevHash and Hash chain records written by a FileSink
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// Sink stores audit records
+type Sink interface {
+	Write(record Record) error
+}
+
+// NewRecord returns a Record for action on target, with the actor and
+// request ID taken from ctx
+func NewRecord(ctx context.Context, action, target string, outcome Outcome, details map[string]string) Record {
+	record := Record{
+		Time:    time.Now().UTC(),
+		Admin:   middlewares.IsAdminFromContext(ctx),
+		Action:  action,
+		Target:  target,
+		Outcome: outcome,
+		Details: details,
+	}
+	record.ActorID, _ = middlewares.UserIDFromContext(ctx)
+	record.OrgID, _ = middlewares.OrgIDFromContext(ctx)
+	record.RequestID, _ = middlewares.RequestIDFromContext(ctx)
+	return record
+}
+
+// Log writes a Record for action on target to sink
+func Log(ctx context.Context, sink Sink, action, target string, outcome Outcome, details map[string]string) error {
+	return sink.Write(NewRecord(ctx, action, target, outcome, details))
+}
+
+// OutcomeForStatus maps a response status to an Outcome: 401 and 403 are
+// denied, other 4xx and 5xx statuses are failures, and the rest succeed
+func OutcomeForStatus(status int) Outcome {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return OutcomeDenied
+	case status >= 400:
+		return OutcomeFailure
+	default:
+		return OutcomeSuccess
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	default:
+		return true
+	}
+}
+
+// Middleware is a middleware that audits every mutating request (any method
+// but GET, HEAD, OPTIONS and TRACE) made by an admin user. The action is the
+// method and path, the target is the path, and the outcome comes from the
+// response status. It reads the user from the request context, so it must be
+// applied inside the middleware that authenticates requests. Requests whose
+// handler panics are recorded with status 500 before the panic continues.
+// Sink errors are logged and don't affect the response.
+func Middleware(sink Sink) middlewares.Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isMutating(r.Method) || !middlewares.IsAdminFromContext(r.Context()) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			wrappedWriter := middlewares.WrapResponseWriter(w)
+			defer func() {
+				rec := recover()
+				status := wrappedWriter.Status()
+				details := map[string]string{"method": r.Method}
+				if rec != nil {
+					status = http.StatusInternalServerError
+					details["panic"] = "true"
+				}
+				details["status"] = strconv.Itoa(status)
+
+				record := NewRecord(r.Context(), r.Method+" "+r.URL.Path, r.URL.Path, OutcomeForStatus(status), details)
+				if err := sink.Write(record); err != nil {
+					zap.L().Error("Error writing audit record", zap.Error(err), zap.String("action", record.Action))
+				}
+				if rec != nil {
+					panic(rec)
+				}
+			}()
+			h.ServeHTTP(wrappedWriter, r)
+		})
+	}
+}
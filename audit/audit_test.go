@@ -0,0 +1,247 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+type memorySink struct {
+	records []Record
+	err     error
+}
+
+func (m *memorySink) Write(record Record) error {
+	m.records = append(m.records, record)
+	return m.err
+}
+
+func TestNewRecord(t *testing.T) {
+	ctx := middlewares.ContextWithUser(context.Background(), "user-1", "org-1", true)
+	ctx = middlewares.ContextWithRequestID(ctx, "req-1")
+	record := NewRecord(ctx, "user.delete", "user-2", OutcomeSuccess, nil)
+
+	if record.ActorID != "user-1" || record.OrgID != "org-1" || !record.Admin || record.RequestID != "req-1" {
+		t.Errorf("Expected the actor and request ID from the context, got %+v", record)
+	}
+	if record.Action != "user.delete" || record.Target != "user-2" || record.Outcome != OutcomeSuccess {
+		t.Errorf("Unexpected record %+v", record)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/forbidden" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+
+	cases := []struct {
+		name        string
+		method      string
+		path        string
+		admin       bool
+		wantOutcome Outcome
+	}{
+		{"Middleware audits admin mutations", http.MethodPost, "/users", true, OutcomeSuccess},
+		{"Middleware records denied requests", http.MethodDelete, "/forbidden", true, OutcomeDenied},
+		{"Middleware skips reads", http.MethodGet, "/users", true, ""},
+		{"Middleware skips non-admins", http.MethodPost, "/users", false, ""},
+	}
+	for _, c := range cases {
+		sink := &memorySink{}
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req = req.WithContext(middlewares.ContextWithUser(req.Context(), "user-1", "org-1", c.admin))
+		Middleware(sink)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		if c.wantOutcome == "" {
+			if len(sink.records) != 0 {
+				t.Errorf("Failed %s: expected no records, got %d", c.name, len(sink.records))
+			}
+			continue
+		}
+		if len(sink.records) != 1 {
+			t.Fatalf("Failed %s: expected 1 record, got %d", c.name, len(sink.records))
+		}
+		record := sink.records[0]
+		if record.Outcome != c.wantOutcome || record.Target != c.path || record.Action != c.method+" "+c.path {
+			t.Errorf("Failed %s: unexpected record %+v", c.name, record)
+		}
+	}
+}
+
+func TestMiddlewarePanics(t *testing.T) {
+	sink := &memorySink{}
+	handler := Middleware(sink)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic("oh no")
+	}))
+	req := httptest.NewRequest(http.MethodDelete, "/users/1", nil)
+	req = req.WithContext(middlewares.ContextWithUser(req.Context(), "user-1", "org-1", true))
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to continue")
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if len(sink.records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(sink.records))
+	}
+	if record := sink.records[0]; record.Outcome != OutcomeFailure || record.Details["status"] != "500" {
+		t.Errorf("Expected a 500 failure record, got %+v", record)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key := []byte("test-key")
+	ctx := middlewares.ContextWithUser(context.Background(), "user-1", "org-1", true)
+
+	if _, err := OpenFileSink(path, nil); err == nil {
+		t.Error("Expected OpenFileSink to require a key")
+	}
+	sink, err := OpenFileSink(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{"a", "b"} {
+		if err := Log(ctx, sink, action, "target", OutcomeSuccess, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	// Reopening continues the chain
+	sink, err = OpenFileSink(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Log(ctx, sink, "c", "target", OutcomeFailure, map[string]string{"reason": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	lastHash := sink.LastHash()
+	sink.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Fatalf("Expected 3 records, got %d", lines)
+	}
+	if hash, err := VerifyChain(bytes.NewReader(data), key); err != nil || hash != lastHash {
+		t.Errorf("Expected a valid chain ending in %s, got %s, %v", lastHash, hash, err)
+	}
+	if _, err := VerifyChain(bytes.NewReader(data), []byte("other-key")); err == nil {
+		t.Error("Expected a different key to fail")
+	}
+
+	tampered := bytes.Replace(data, []byte(`"action":"b"`), []byte(`"action":"x"`), 1)
+	if _, err := VerifyChain(bytes.NewReader(tampered), key); err == nil {
+		t.Error("Expected an edited record to break the chain")
+	}
+	removed := data[bytes.IndexByte(data, '\n')+1:]
+	if _, err := VerifyChain(bytes.NewReader(removed), key); err == nil {
+		t.Error("Expected a removed record to break the chain")
+	}
+
+	os.WriteFile(path, tampered, 0600)
+	if _, err := OpenFileSink(path, key); err == nil {
+		t.Error("Expected OpenFileSink to refuse a corrupt file")
+	}
+}
+
+func TestFileSinkIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	key := []byte("test-key")
+	ctx := middlewares.ContextWithUser(context.Background(), "user-1", "org-1", true)
+
+	sink, err := OpenFileSink(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Log(ctx, sink, "a", "target", OutcomeSuccess, nil)
+	sink.Close()
+	complete, _ := os.ReadFile(path)
+
+	// A crash part way through writing a record leaves a line without a newline
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"time":"2020-01-01T00:00:00Z","actor_id":"us`)
+	file.Close()
+
+	sink, err = OpenFileSink(path, key)
+	if err != nil {
+		t.Fatalf("Expected the incomplete record to be truncated, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, complete) {
+		t.Errorf("Expected the file to be truncated to %q, got %q", complete, data)
+	}
+	if err := Log(ctx, sink, "b", "target", OutcomeSuccess, nil); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	data, _ := os.ReadFile(path)
+	if _, err := VerifyChain(bytes.NewReader(data), key); err != nil {
+		t.Errorf("Expected a valid chain, got %v", err)
+	}
+}
+
+func TestZapSink(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	sink := NewZapSink(zap.New(core))
+	sink.Write(Record{Action: "user.delete", ActorID: "user-1", Outcome: OutcomeSuccess})
+
+	logs := observed.All()
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(logs))
+	}
+	fields := logs[0].ContextMap()
+	if fields["action"] != "user.delete" || fields["actor_id"] != "user-1" || fields["audit"] != true {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	first, second := &memorySink{err: errors.New("failed")}, &memorySink{}
+	err := MultiSink(first, second).Write(Record{Action: "a"})
+	if err == nil {
+		t.Error("Expected the first sink's error")
+	}
+	if len(first.records) != 1 || len(second.records) != 1 {
+		t.Error("Expected every sink to be written")
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+	if err := client.Ping().Err(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+
+	stream := "test:audit:" + time.Now().String()
+	defer client.Del(stream)
+	if err := NewRedisSink(client, stream, 100).Write(Record{Action: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := client.XLen(stream).Val(); n != 1 {
+		t.Errorf("Expected 1 stream entry, got %d", n)
+	}
+}
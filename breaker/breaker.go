@@ -0,0 +1,373 @@
+/*
+Package breaker provides circuit breakers that stop calls to a failing
+dependency, such as Redis or a downstream service, so requests fail fast
+instead of each waiting for a timeout.
+
+A Breaker starts closed, letting calls through and counting their outcomes in
+a rolling window. It opens when too many calls fail, rejecting calls with
+ErrOpen. After OpenTimeout it becomes half-open and lets a few probe calls
+through: if they succeed it closes, and if any fails it opens again.
+
+	b := breaker.New("billing", breaker.Options{})
+	client := httpclient.New(httpclient.Options{
+		Middlewares: append(httpclient.DefaultMiddlewares(), breaker.Transport(b)),
+	})
+*/
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/skuid/spec/lifecycle"
+	"github.com/skuid/spec/middlewares"
+	"github.com/skuid/spec/version"
+	"go.uber.org/zap"
+)
+
+// ErrOpen is returned for calls rejected by an open Breaker
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a Breaker
+type State int
+
+const (
+	// StateClosed lets all calls through
+	StateClosed State = iota
+	// StateOpen rejects all calls
+	StateOpen
+	// StateHalfOpen lets a limited number of probe calls through
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Options configures a Breaker
+type Options struct {
+	// FailureRate opens the breaker once this fraction of calls in Window
+	// have failed. Defaults to 0.5.
+	FailureRate float64
+	// MinRequests is the number of calls Window must hold before
+	// FailureRate is considered. Defaults to 20.
+	MinRequests int
+	// ConsecutiveFailures opens the breaker after this many failures in a
+	// row, regardless of the failure rate. Defaults to 5.
+	ConsecutiveFailures int
+	// Window is the rolling window calls are counted in, split into Buckets
+	// that expire one at a time. Defaults to 10s and 10 buckets.
+	Window  time.Duration
+	Buckets int
+	// OpenTimeout is how long the breaker stays open before letting probe
+	// calls through. Defaults to 30s.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probe calls allowed while half-open,
+	// all of which must succeed to close the breaker. Defaults to 1.
+	HalfOpenRequests int
+	// IsFailure decides whether a call's error counts as a failure. Defaults
+	// to any error other than context.Canceled, which is the caller giving up
+	// rather than the dependency failing.
+	IsFailure func(error) bool
+	// Readiness, if set, marks the application not ready with
+	// lifecycle.MarkNotReady while the breaker is open, for services that
+	// can't do useful work without the dependency. Readiness returns when the
+	// breaker becomes half-open after OpenTimeout, even if no calls arrive, so
+	// probe traffic can reach the application.
+	Readiness bool
+}
+
+// DefaultIsFailure is the default Options.IsFailure
+func DefaultIsFailure(err error) bool {
+	return err != nil && !errors.Is(err, context.Canceled)
+}
+
+type bucket struct {
+	successes int
+	failures  int
+}
+
+// Breaker is a circuit breaker. It is safe for concurrent use.
+type Breaker struct {
+	name string
+	opts Options
+	now  func() time.Time
+
+	mu          sync.Mutex
+	state       State
+	generation  uint64
+	buckets     []bucket
+	current     int
+	bucketStart time.Time
+	consecutive int
+	openedAt    time.Time
+	openTimer   *time.Timer
+	probes      int
+	probeWins   int
+	release     func()
+}
+
+// New returns a closed Breaker. name identifies the breaker in logs and
+// metrics. The following metrics are added:
+//
+//	# Counter
+//	circuit_breaker_state_change{"sha", "breaker", "from", "to"}
+//	# Counter
+//	circuit_breaker_rejected{"sha", "breaker"}
+func New(name string, opts Options) *Breaker {
+	if opts.FailureRate <= 0 {
+		opts.FailureRate = 0.5
+	}
+	if opts.MinRequests <= 0 {
+		opts.MinRequests = 20
+	}
+	if opts.ConsecutiveFailures <= 0 {
+		opts.ConsecutiveFailures = 5
+	}
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.Buckets <= 0 {
+		opts.Buckets = 10
+	}
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+	if opts.IsFailure == nil {
+		opts.IsFailure = DefaultIsFailure
+	}
+	b := &Breaker{
+		name:    name,
+		opts:    opts,
+		now:     time.Now,
+		buckets: make([]bucket, opts.Buckets),
+	}
+	b.bucketStart = b.now()
+	return b
+}
+
+// Name returns the name the breaker was created with
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the breaker's current state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expireOpen(b.now())
+	return b.state
+}
+
+// Allow reports whether a call may be made. If it may, done must be called
+// with the call's error once it completes. Calls that aren't allowed get
+// ErrOpen.
+func (b *Breaker) Allow() (done func(error), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.expireOpen(b.now())
+	switch b.state {
+	case StateOpen:
+		b.rejected()
+		return nil, ErrOpen
+	case StateHalfOpen:
+		if b.probes >= b.opts.HalfOpenRequests {
+			b.rejected()
+			return nil, ErrOpen
+		}
+		b.probes++
+	}
+
+	generation := b.generation
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() { b.record(generation, err) })
+	}, nil
+}
+
+// Do calls fn if the breaker allows it, recording its outcome
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	done(err)
+	return err
+}
+
+// record counts the outcome of a call allowed in generation. Outcomes from an
+// earlier state are ignored.
+func (b *Breaker) record(generation uint64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	failed := b.opts.IsFailure(err)
+	now := b.now()
+
+	if b.state == StateHalfOpen {
+		switch {
+		case failed:
+			b.transition(StateOpen, now)
+		case err == nil:
+			b.probeWins++
+			if b.probeWins >= b.opts.HalfOpenRequests {
+				b.transition(StateClosed, now)
+			}
+		default:
+			// Ignored errors free the probe for another call
+			b.probes--
+		}
+		return
+	}
+
+	if err != nil && !failed {
+		return
+	}
+	b.advance(now)
+	if !failed {
+		b.buckets[b.current].successes++
+		b.consecutive = 0
+		return
+	}
+	b.buckets[b.current].failures++
+	b.consecutive++
+
+	if b.consecutive >= b.opts.ConsecutiveFailures {
+		b.transition(StateOpen, now)
+		return
+	}
+	var total, failures int
+	for _, counts := range b.buckets {
+		total += counts.successes + counts.failures
+		failures += counts.failures
+	}
+	if total >= b.opts.MinRequests && float64(failures)/float64(total) >= b.opts.FailureRate {
+		b.transition(StateOpen, now)
+	}
+}
+
+// advance moves the rolling window forward to now, clearing expired buckets.
+// b.mu must be held.
+func (b *Breaker) advance(now time.Time) {
+	width := b.opts.Window / time.Duration(len(b.buckets))
+	elapsed := int(now.Sub(b.bucketStart) / width)
+	if elapsed <= 0 {
+		return
+	}
+	if elapsed >= len(b.buckets) {
+		b.resetWindow(now)
+		return
+	}
+	for i := 0; i < elapsed; i++ {
+		b.current = (b.current + 1) % len(b.buckets)
+		b.buckets[b.current] = bucket{}
+	}
+	b.bucketStart = b.bucketStart.Add(time.Duration(elapsed) * width)
+}
+
+// resetWindow clears the rolling window. b.mu must be held.
+func (b *Breaker) resetWindow(now time.Time) {
+	for i := range b.buckets {
+		b.buckets[i] = bucket{}
+	}
+	b.current = 0
+	b.bucketStart = now
+}
+
+// expireOpen moves an open breaker to half-open once OpenTimeout has passed,
+// in case a call arrives before the timer started by transition fires. b.mu
+// must be held.
+func (b *Breaker) expireOpen(now time.Time) {
+	if b.state == StateOpen && now.Sub(b.openedAt) >= b.opts.OpenTimeout {
+		b.transition(StateHalfOpen, now)
+	}
+}
+
+// transition changes the breaker's state, logging and counting the change.
+// b.mu must be held.
+func (b *Breaker) transition(to State, now time.Time) {
+	from := b.state
+	b.state = to
+	b.generation++
+	b.probes = 0
+	b.probeWins = 0
+	if b.openTimer != nil {
+		b.openTimer.Stop()
+		b.openTimer = nil
+	}
+
+	switch to {
+	case StateOpen:
+		b.openedAt = now
+		// Become half-open without waiting for a call, which may never come
+		// while the application is marked not ready
+		generation := b.generation
+		b.openTimer = time.AfterFunc(b.opts.OpenTimeout, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.generation == generation && b.state == StateOpen {
+				b.transition(StateHalfOpen, b.now())
+			}
+		})
+		zap.L().Warn("Circuit breaker opened", zap.String("breaker", b.name), zap.String("from", from.String()))
+	case StateHalfOpen:
+		zap.L().Info("Circuit breaker half-open", zap.String("breaker", b.name))
+	case StateClosed:
+		b.resetWindow(now)
+		b.consecutive = 0
+		zap.L().Info("Circuit breaker closed", zap.String("breaker", b.name))
+	}
+	if statsdClient := middlewares.Client(); statsdClient != nil {
+		tags := append(b.tags(), fmt.Sprintf("%s:%s", "from", from), fmt.Sprintf("%s:%s", "to", to))
+		statsdClient.Incr("circuit_breaker_state_change", tags, 1)
+	}
+	if b.opts.Readiness {
+		b.setReady(to != StateOpen)
+	}
+}
+
+// rejected counts a call rejected by the breaker. b.mu must be held.
+func (b *Breaker) rejected() {
+	if statsdClient := middlewares.Client(); statsdClient != nil {
+		statsdClient.Incr("circuit_breaker_rejected", b.tags(), 1)
+	}
+}
+
+func (b *Breaker) tags() []string {
+	return []string{
+		fmt.Sprintf("%s:%s", "sha", version.Commit),
+		fmt.Sprintf("%s:%s", "breaker", b.name),
+	}
+}
+
+// setReady takes or releases this breaker's lifecycle.MarkNotReady hold. b.mu
+// must be held.
+func (b *Breaker) setReady(ready bool) {
+	switch {
+	case !ready && b.release == nil:
+		b.release = lifecycle.MarkNotReady()
+		zap.L().Warn("Circuit breaker open, marking application not ready", zap.String("breaker", b.name))
+	case ready && b.release != nil:
+		b.release()
+		b.release = nil
+		zap.L().Info("Circuit breaker no longer open, releasing readiness", zap.String("breaker", b.name))
+	}
+}
@@ -0,0 +1,159 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/skuid/spec/lifecycle"
+)
+
+var errFailed = errors.New("failed")
+
+// newTestBreaker returns a Breaker with a clock advanced by the returned
+// function
+func newTestBreaker(opts Options) (*Breaker, func(time.Duration)) {
+	now := time.Unix(1600000000, 0)
+	b := New("test", opts)
+	b.now = func() time.Time { return now }
+	b.bucketStart = now
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func call(b *Breaker, err error) error {
+	return b.Do(func() error { return err })
+}
+
+func TestConsecutiveFailures(t *testing.T) {
+	b, tick := newTestBreaker(Options{ConsecutiveFailures: 3, OpenTimeout: time.Hour})
+
+	call(b, errFailed)
+	call(b, errFailed)
+	call(b, nil)
+	call(b, errFailed)
+	call(b, errFailed)
+	if b.State() != StateClosed {
+		t.Fatal("Expected a success to reset consecutive failures")
+	}
+	call(b, errFailed)
+	if b.State() != StateOpen {
+		t.Fatalf("Expected the breaker to open, got %s", b.State())
+	}
+	if err := call(b, nil); err != ErrOpen {
+		t.Errorf("Expected ErrOpen, got %v", err)
+	}
+
+	tick(time.Hour)
+	if b.State() != StateHalfOpen {
+		t.Fatalf("Expected the breaker to be half-open, got %s", b.State())
+	}
+	done, err := b.Allow()
+	if err != nil {
+		t.Fatalf("Expected a probe to be allowed, got %v", err)
+	}
+	if _, err := b.Allow(); err != ErrOpen {
+		t.Errorf("Expected a second probe to be rejected, got %v", err)
+	}
+	done(errFailed)
+	if b.State() != StateOpen {
+		t.Fatalf("Expected a failed probe to reopen the breaker, got %s", b.State())
+	}
+
+	tick(time.Hour)
+	if err := call(b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != StateClosed {
+		t.Errorf("Expected a successful probe to close the breaker, got %s", b.State())
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	b, tick := newTestBreaker(Options{FailureRate: 0.5, MinRequests: 10, ConsecutiveFailures: 100, Window: 10 * time.Second})
+
+	for i := 0; i < 4; i++ {
+		call(b, nil)
+		call(b, errFailed)
+	}
+	if b.State() != StateClosed {
+		t.Fatal("Expected the breaker to wait for MinRequests")
+	}
+	// The first calls expire from the window
+	tick(10 * time.Second)
+	for i := 0; i < 4; i++ {
+		call(b, nil)
+		call(b, errFailed)
+	}
+	if b.State() != StateClosed {
+		t.Fatal("Expected expired calls not to count")
+	}
+	tick(time.Second)
+	call(b, nil)
+	call(b, errFailed)
+	if b.State() != StateOpen {
+		t.Errorf("Expected the failure rate to open the breaker, got %s", b.State())
+	}
+}
+
+func TestIgnoredOutcomes(t *testing.T) {
+	b, tick := newTestBreaker(Options{ConsecutiveFailures: 1, OpenTimeout: time.Hour})
+
+	call(b, context.Canceled)
+	if b.State() != StateClosed {
+		t.Fatal("Expected context.Canceled not to count as a failure")
+	}
+
+	// A call started before the breaker opened doesn't affect later states
+	late, _ := b.Allow()
+	call(b, errFailed)
+	tick(time.Hour)
+	late(nil)
+	if b.State() != StateHalfOpen {
+		t.Errorf("Expected a stale outcome to be ignored, got %s", b.State())
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	first, tick := newTestBreaker(Options{ConsecutiveFailures: 1, OpenTimeout: time.Hour, Readiness: true})
+	second, tickSecond := newTestBreaker(Options{ConsecutiveFailures: 1, OpenTimeout: time.Hour, Readiness: true})
+
+	call(first, errFailed)
+	call(second, errFailed)
+	if lifecycle.IsReady() {
+		t.Fatal("Expected an open breaker to mark the application not ready")
+	}
+	tick(time.Hour)
+	call(first, nil)
+	if lifecycle.IsReady() {
+		t.Fatal("Expected the application to stay not ready while a breaker is open")
+	}
+	tickSecond(time.Hour)
+	call(second, nil)
+	if !lifecycle.IsReady() {
+		t.Error("Expected the application to be ready once every breaker closed")
+	}
+}
+
+func TestReadinessWithoutCalls(t *testing.T) {
+	b := New("test", Options{ConsecutiveFailures: 1, OpenTimeout: 20 * time.Millisecond, Readiness: true})
+	call(b, errFailed)
+	if lifecycle.IsReady() {
+		t.Fatal("Expected an open breaker to mark the application not ready")
+	}
+
+	// No calls arrive while the application is out of rotation
+	deadline := time.Now().Add(time.Second)
+	for !lifecycle.IsReady() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !lifecycle.IsReady() {
+		t.Fatal("Expected readiness to return after OpenTimeout without any calls")
+	}
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	if state != StateHalfOpen {
+		t.Errorf("Expected the breaker to become half-open on its own, got %s", state)
+	}
+}
@@ -0,0 +1,91 @@
+package breaker
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skuid/spec/cache"
+	"github.com/skuid/spec/httpclient"
+)
+
+// ServerError is recorded as the failure of a request that got a 5xx
+// response
+type ServerError struct {
+	StatusCode int
+}
+
+func (e ServerError) Error() string {
+	return fmt.Sprintf("server error: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Transport returns a client middleware that sends requests through b.
+// Transport errors and 5xx responses count as failures, and requests
+// rejected by an open breaker fail with ErrOpen. Place it after Retry so
+// each attempt is counted and retries stop once the breaker opens.
+func Transport(b *Breaker) httpclient.Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return httpclient.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			done, err := b.Allow()
+			if err != nil {
+				return nil, err
+			}
+			resp, err := next.RoundTrip(req)
+			switch {
+			case err != nil:
+				done(err)
+			case resp.StatusCode >= 500:
+				done(ServerError{StatusCode: resp.StatusCode})
+			default:
+				done(nil)
+			}
+			return resp, err
+		})
+	}
+}
+
+// Cache wraps the cache package's Get and Set with a Breaker. A missing key
+// is not a failure.
+type Cache struct {
+	breaker *Breaker
+}
+
+// NewCache returns a Cache that calls the cache package through b
+func NewCache(b *Breaker) *Cache {
+	return &Cache{breaker: b}
+}
+
+// Get calls cache.Get, or returns ErrOpen if the breaker is open
+func (c *Cache) Get(key string) (string, error) {
+	var value string
+	err := c.do(func() (err error) {
+		value, err = cache.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Set calls cache.Set, or returns ErrOpen if the breaker is open
+func (c *Cache) Set(key string, value string, expirationSeconds time.Duration) (interface{}, error) {
+	var result interface{}
+	err := c.do(func() (err error) {
+		result, err = cache.Set(key, value, expirationSeconds)
+		return err
+	})
+	return result, err
+}
+
+func (c *Cache) do(fn func() error) error {
+	done, err := c.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err == redis.Nil {
+		done(nil)
+	} else {
+		done(err)
+	}
+	return err
+}
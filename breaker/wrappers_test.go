@@ -0,0 +1,68 @@
+package breaker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/skuid/spec/cache"
+	"github.com/skuid/spec/httpclient"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	b := New("test", Options{ConsecutiveFailures: 2})
+	client := httpclient.New(httpclient.Options{Middlewares: []httpclient.Middleware{Transport(b)}})
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Expected the response while closed, got %v", err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrOpen) {
+		t.Errorf("Expected ErrOpen after repeated 5xx responses, got %v", err)
+	}
+}
+
+// failingRedis fails every Get and Set, except Gets of missing keys
+type failingRedis struct {
+	redis.Cmdable
+}
+
+func (failingRedis) Get(key string) *redis.StringCmd {
+	if key == "missing" {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult("", errors.New("connection refused"))
+}
+
+func (failingRedis) Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	return redis.NewStatusResult("", errors.New("connection refused"))
+}
+
+func TestCache(t *testing.T) {
+	cache.SetConnection(failingRedis{})
+	defer cache.SetConnection(nil)
+
+	c := NewCache(New("redis", Options{ConsecutiveFailures: 2}))
+	c.Get("key")
+	if _, err := c.Get("missing"); err != redis.Nil {
+		t.Fatalf("Expected the missing key error, got %v", err)
+	}
+	if _, err := c.Get("missing"); err != redis.Nil {
+		t.Fatalf("Expected missing keys not to count as failures, got %v", err)
+	}
+	c.Get("key")
+	c.Set("key", "value", time.Second)
+	if _, err := c.Get("key"); err != ErrOpen {
+		t.Errorf("Expected ErrOpen after repeated Redis errors, got %v", err)
+	}
+}
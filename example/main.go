@@ -75,12 +75,12 @@ func main() {
 	mux.HandleFunc("/flip", flip)
 	mux.HandleFunc("/random", random)
 
-	handler := middlewares.Apply(
-		mux,
+	handler := middlewares.NewChain(
+		middlewares.SecurityHeaders(middlewares.APISecurityPolicy()),
+		middlewares.CORS(middlewares.CORSOptions{AllowedOrigins: []string{"*"}}),
 		middlewares.InstrumentRoute(),
-		middlewares.AccessControlAllowOrigin("*"),
-		middlewares.AddHeaders(map[string]string{"X-Frame-Options": "DENY"}),
-	)
+		middlewares.Recover(),
+	).Then(mux)
 
 	internalMux := http.NewServeMux()
 	internalMux.Handle("/", handler)
@@ -11,6 +11,7 @@ require (
 	github.com/spf13/viper v1.2.1
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7
 	google.golang.org/grpc v1.29.1
 	gopkg.in/vmihailenco/msgpack.v2 v2.9.1
 )
@@ -32,7 +33,6 @@ require (
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
 	go.uber.org/atomic v1.6.0 // indirect
 	go.uber.org/multierr v1.5.0 // indirect
-	golang.org/x/net v0.0.0-20200520004742-59133d7f0dd7 // indirect
 	golang.org/x/sys v0.0.0-20200519105757-fe76b779f299 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	google.golang.org/appengine v1.4.0 // indirect
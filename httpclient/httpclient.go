@@ -0,0 +1,102 @@
+/*
+Package httpclient provides an HTTP client with the same observability as the
+server middlewares: request logs, statsd metrics, and propagation of the
+request ID, trace headers and user to downstream services.
+
+	client := httpclient.New(httpclient.Options{})
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	resp, err := client.Do(req)
+
+Behavior is built from Middlewares wrapping an http.RoundTripper, which can be
+combined into custom clients with Wrap. To forward the user to internal
+services, add ForwardUser with the hosts that may receive it:
+
+	client := httpclient.New(httpclient.Options{
+		Middlewares: append(httpclient.DefaultMiddlewares(), httpclient.ForwardUser("billing.internal")),
+	})
+*/
+package httpclient
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// RoundTripperFunc is an adapter to allow the use of ordinary functions as
+// http.RoundTrippers
+type RoundTripperFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip satisfies the http.RoundTripper interface
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Middleware is a type for decorating outgoing requests
+type Middleware func(http.RoundTripper) http.RoundTripper
+
+// Wrap wraps middlewares around rt and returns it. Middlewares are listed
+// outermost first, so the first middleware sees each request first.
+func Wrap(rt http.RoundTripper, middlewares ...Middleware) http.RoundTripper {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		rt = middlewares[i](rt)
+	}
+	return rt
+}
+
+// Options configures a client created with New
+type Options struct {
+	// Timeout bounds each request, including reading the response body.
+	// Defaults to 30 seconds.
+	Timeout time.Duration
+	// Transport sends requests. Defaults to NewTransport().
+	Transport http.RoundTripper
+	// Middlewares wrap Transport, outermost first. Defaults to
+	// DefaultMiddlewares().
+	Middlewares []Middleware
+}
+
+// DefaultMiddlewares returns the middlewares used by New when none are
+// configured: Logging, Instrument and Propagate. ForwardUser is left out
+// because it sends the user's identity, and must be added with the hosts
+// trusted to receive it.
+func DefaultMiddlewares() []Middleware {
+	return []Middleware{Logging(), Instrument(), Propagate()}
+}
+
+// NewTransport returns an http.Transport with bounded dial, TLS handshake
+// and response header timeouts, and a connection pool sized for services
+// that make many requests to a few hosts
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// New returns an http.Client configured by opts
+func New(opts Options) *http.Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+	if opts.Transport == nil {
+		opts.Transport = NewTransport()
+	}
+	if opts.Middlewares == nil {
+		opts.Middlewares = DefaultMiddlewares()
+	}
+	return &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: Wrap(opts.Transport, opts.Middlewares...),
+	}
+}
@@ -0,0 +1,154 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skuid/spec/middlewares"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWrap(t *testing.T) {
+	order := []string{}
+	tag := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	rt := Wrap(RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}), tag("a"), tag("b"))
+	rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Errorf("Expected middlewares to run outermost first, got %v", order)
+	}
+}
+
+func TestNew(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	incoming := httptest.NewRequest(http.MethodGet, "/", nil)
+	incoming.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	incoming.Header.Set("X-Unrelated", "value")
+	ctx := ContextWithTraceHeaders(incoming.Context(), incoming.Header)
+	ctx = middlewares.ContextWithRequestID(ctx, "req-1")
+	ctx = middlewares.ContextWithIdentity(ctx, middlewares.Identity{UserID: "user-1", OrgID: "org-1", Roles: []string{"a", "b"}})
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/items?token=secret", nil)
+	resp, err := New(Options{Middlewares: append(DefaultMiddlewares(), ForwardUser("127.0.0.1"))}).Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	for name, want := range map[string]string{
+		middlewares.RequestIDHeader: "req-1",
+		"Traceparent":               "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		HeaderUserID:                "user-1",
+		HeaderOrgID:                 "org-1",
+		HeaderAdmin:                 "false",
+		HeaderRoles:                 "a,b",
+		"X-Unrelated":               "",
+		HeaderScopes:                "",
+	} {
+		if got := received.Get(name); got != want {
+			t.Errorf("Expected %s %q, got %q", name, want, got)
+		}
+	}
+	if len(req.Header) != 0 {
+		t.Errorf("Expected the original request to be unmodified, got %v", req.Header)
+	}
+
+	logs := observed.TakeAll()
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(logs))
+	}
+	fields := logs[0].ContextMap()
+	if logs[0].Level != zapcore.WarnLevel || fields["status"] != int64(http.StatusNotFound) || fields["requestId"] != "req-1" {
+		t.Errorf("Unexpected log %v %v", logs[0].Level, fields)
+	}
+	if fields["url"] != server.URL+"/items" {
+		t.Errorf("Expected the query to be left out of the URL, got %v", fields["url"])
+	}
+}
+
+func TestForwardUser(t *testing.T) {
+	ctx := middlewares.ContextWithIdentity(context.Background(), middlewares.Identity{UserID: "user-1", OrgID: "org-1"})
+	cases := []struct {
+		name     string
+		hosts    []string
+		url      string
+		wantUser string
+	}{
+		{"ForwardUser forwards to allowed hosts", []string{"billing.internal"}, "http://billing.internal:8080/", "user-1"},
+		{"ForwardUser matches subdomains", []string{"*.internal"}, "http://billing.internal/", "user-1"},
+		{"ForwardUser skips other hosts", []string{"billing.internal"}, "https://api.example.com/", ""},
+		{"ForwardUser doesn't match the parent domain of a wildcard", []string{"*.internal"}, "http://internal/", ""},
+		{"ForwardUser forwards nothing without hosts", nil, "http://billing.internal/", ""},
+	}
+	for _, c := range cases {
+		var received http.Header
+		rt := ForwardUser(c.hosts...)(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			received = req.Header
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		}))
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+		rt.RoundTrip(req)
+		if got := received.Get(HeaderUserID); got != c.wantUser {
+			t.Errorf("Failed %s: expected user %q, got %q", c.name, c.wantUser, got)
+		}
+	}
+}
+
+func TestPropagateKeepsExistingHeaders(t *testing.T) {
+	var received http.Header
+	rt := Propagate()(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		received = req.Header
+		return &http.Response{StatusCode: http.StatusOK}, nil
+	}))
+	ctx := middlewares.ContextWithRequestID(context.Background(), "from-context")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	req.Header.Set(middlewares.RequestIDHeader, "explicit")
+	rt.RoundTrip(req)
+
+	if got := received.Get(middlewares.RequestIDHeader); got != "explicit" {
+		t.Errorf("Expected the explicit request ID to be kept, got %q", got)
+	}
+}
+
+func TestLoggingErrors(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	rt := Wrap(RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}), Logging(), Instrument())
+	_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "http://example.com", nil))
+	if err == nil {
+		t.Fatal("Expected the transport error")
+	}
+
+	logs := observed.TakeAll()
+	if len(logs) != 1 || logs[0].Level != zapcore.ErrorLevel || logs[0].ContextMap()["error"] != "connection refused" {
+		t.Errorf("Expected an error log, got %v", logs)
+	}
+}
@@ -0,0 +1,236 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skuid/spec/middlewares"
+	"github.com/skuid/spec/version"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Headers used to forward the Identity stored in a request context. They
+// match the gRPC metadata keys in the middlewares package.
+const (
+	HeaderUserID    = "X-User-Id"
+	HeaderOrgID     = "X-Org-Id"
+	HeaderSubdomain = "X-Subdomain"
+	HeaderAdmin     = "X-Admin"
+	HeaderRoles     = "X-Roles"
+	HeaderScopes    = "X-Scopes"
+)
+
+// TraceHeaders are the distributed tracing headers captured by
+// CaptureTraceHeaders and sent by Propagate
+var TraceHeaders = []string{
+	"traceparent",
+	"tracestate",
+	"b3",
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+	"X-Datadog-Trace-Id",
+	"X-Datadog-Parent-Id",
+	"X-Datadog-Sampling-Priority",
+	"X-Datadog-Origin",
+}
+
+type contextKey string
+
+var traceHeadersContextKey = contextKey("traceHeaders")
+
+// ContextWithTraceHeaders places the TraceHeaders found in header into ctx
+func ContextWithTraceHeaders(ctx context.Context, header http.Header) context.Context {
+	trace := http.Header{}
+	for _, name := range TraceHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			trace[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	if len(trace) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, traceHeadersContextKey, trace)
+}
+
+// TraceHeadersFromContext retrieves the trace headers stored in ctx
+func TraceHeadersFromContext(ctx context.Context) http.Header {
+	trace, _ := ctx.Value(traceHeadersContextKey).(http.Header)
+	return trace
+}
+
+// CaptureTraceHeaders is a server middleware that stores the trace headers of
+// incoming requests in the request context, so Propagate can send them on
+func CaptureTraceHeaders() middlewares.Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(ContextWithTraceHeaders(r.Context(), r.Header)))
+		})
+	}
+}
+
+// redactedURL returns the URL of req without its query or credentials, which
+// may hold secrets
+func redactedURL(req *http.Request) string {
+	return req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+}
+
+// Logging logs each outgoing request with its method, URL (without the
+// query), status, duration, and the request ID and user from the request
+// context. Responses are logged at the level middlewares.StatusLogLevel picks
+// and transport errors at Error level.
+func Logging() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+
+			fields := []zapcore.Field{
+				zap.String("method", req.Method),
+				zap.String("url", redactedURL(req)),
+				zap.Duration("duration", time.Since(start)),
+			}
+			level := zapcore.ErrorLevel
+			if err != nil {
+				fields = append(fields, zap.Error(err))
+			} else {
+				fields = append(fields, zap.Int("status", resp.StatusCode))
+				level = middlewares.StatusLogLevel(resp.StatusCode)
+			}
+			if requestID, idErr := middlewares.RequestIDFromContext(req.Context()); idErr == nil {
+				fields = append(fields, zap.String("requestId", requestID))
+			}
+			if userID, idErr := middlewares.UserIDFromContext(req.Context()); idErr == nil {
+				fields = append(fields, zap.String("userId", userID))
+			}
+			if ce := zap.L().Check(level, "HTTP client request"); ce != nil {
+				ce.Write(fields...)
+			}
+			return resp, err
+		})
+	}
+}
+
+// Instrument adds metrics for outgoing requests. Requests that fail without
+// a response are tagged with status:error. The following metrics are added:
+//
+//	# Counter
+//	http_client_request_count{"sha", "method", "host", "status"}
+//	# Histogram
+//	http_client_request_duration{"sha", "method", "host", "status"}
+func Instrument() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+
+			if statsdClient := middlewares.Client(); statsdClient != nil {
+				status := "error"
+				if err == nil {
+					status = strconv.Itoa(resp.StatusCode)
+				}
+				elapsed := float64((time.Since(start)) / time.Microsecond)
+				tags := []string{
+					fmt.Sprintf("%s:%s", "sha", version.Commit),
+					fmt.Sprintf("%s:%s", "method", strings.ToLower(req.Method)),
+					fmt.Sprintf("%s:%s", "host", req.URL.Hostname()),
+					fmt.Sprintf("%s:%s", "status", status),
+				}
+				statsdClient.Incr("http_client_request_count", tags, 1)
+				statsdClient.Histogram("http_client_request_duration", elapsed, tags, 1)
+			}
+			return resp, err
+		})
+	}
+}
+
+// Propagate sends the request ID and trace headers stored in the request
+// context with each outgoing request, without overriding headers that are
+// already set
+func Propagate() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header := http.Header{}
+			if requestID, err := middlewares.RequestIDFromContext(req.Context()); err == nil {
+				header.Set(middlewares.RequestIDHeader, requestID)
+			}
+			for name, values := range TraceHeadersFromContext(req.Context()) {
+				header[name] = values
+			}
+			return next.RoundTrip(withHeaders(req, header))
+		})
+	}
+}
+
+// ForwardUser sends the Identity stored in the request context with outgoing
+// requests to hosts, so trusted downstream services can act on behalf of the
+// same user. Hosts are matched against the request's host name without the
+// port, and a host starting with "*." matches any subdomain. Requests to other
+// hosts are sent without the identity headers.
+func ForwardUser(hosts ...string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !hostAllowed(hosts, req.URL.Hostname()) {
+				return next.RoundTrip(req)
+			}
+			identity, err := middlewares.IdentityFromContext(req.Context())
+			if err != nil || identity.UserID == "" {
+				return next.RoundTrip(req)
+			}
+			header := http.Header{}
+			header.Set(HeaderUserID, identity.UserID)
+			header.Set(HeaderOrgID, identity.OrgID)
+			header.Set(HeaderSubdomain, identity.Subdomain)
+			header.Set(HeaderAdmin, strconv.FormatBool(identity.Admin))
+			if len(identity.Roles) > 0 {
+				header.Set(HeaderRoles, strings.Join(identity.Roles, ","))
+			}
+			if len(identity.Scopes) > 0 {
+				header.Set(HeaderScopes, strings.Join(identity.Scopes, ","))
+			}
+			return next.RoundTrip(withHeaders(req, header))
+		})
+	}
+}
+
+// hostAllowed reports whether host matches one of hosts
+func hostAllowed(hosts []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed {
+			return true
+		}
+		if domain := strings.TrimPrefix(allowed, "*."); domain != allowed && strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// withHeaders returns a copy of req with the headers in header that it
+// doesn't already have. RoundTrippers must not modify the request they are
+// given.
+func withHeaders(req *http.Request, header http.Header) *http.Request {
+	missing := http.Header{}
+	for name, values := range header {
+		if req.Header.Get(name) == "" && len(values) > 0 && values[0] != "" {
+			missing[name] = values
+		}
+	}
+	if len(missing) == 0 {
+		return req
+	}
+	clone := req.Clone(req.Context())
+	for name, values := range missing {
+		clone.Header[name] = values
+	}
+	return clone
+}
@@ -0,0 +1,262 @@
+package httpclient
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skuid/spec/middlewares"
+	"github.com/skuid/spec/version"
+)
+
+// RetryBudget limits retries to a fraction of requests, so that retries
+// can't multiply the load on a struggling service. Each request deposits
+// ratio tokens, each retry withdraws one, and minPerSecond tokens are added
+// every second so that low traffic can still be retried. A RetryBudget can
+// be shared between clients calling the same service.
+type RetryBudget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	max          float64
+	balance      float64
+	last         time.Time
+	now          func() time.Time
+}
+
+// NewRetryBudget returns a RetryBudget allowing retries of ratio of requests
+// (0.1 allows one retry per ten requests), plus minPerSecond retries a
+// second
+func NewRetryBudget(ratio float64, minPerSecond int) *RetryBudget {
+	b := &RetryBudget{ratio: ratio, minPerSecond: float64(minPerSecond), now: time.Now}
+	// Allow ten seconds of minimum retries, or ten retries, to accumulate
+	b.max = math.Max(10*b.minPerSecond, 10)
+	b.balance = b.minPerSecond
+	b.last = b.now()
+	return b
+}
+
+// refill adds the tokens earned since the last call. b.mu must be held.
+func (b *RetryBudget) refill() {
+	now := b.now()
+	b.balance = math.Min(b.max, b.balance+now.Sub(b.last).Seconds()*b.minPerSecond)
+	b.last = now
+}
+
+// deposit records a request
+func (b *RetryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.balance = math.Min(b.max, b.balance+b.ratio)
+}
+
+// withdraw reports whether a retry is allowed, spending a token if it is
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// RetryOptions configures the Retry middleware
+type RetryOptions struct {
+	// MaxAttempts is the number of times a request is sent, including the
+	// first. Defaults to 3.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, which doubles on
+	// each retry up to MaxBackoff. Defaults to 100ms and 5s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxRetryAfter is the longest Retry-After a response may ask for and
+	// still be retried. Defaults to 30s.
+	MaxRetryAfter time.Duration
+	// Budget limits retries across requests. Defaults to
+	// NewRetryBudget(0.1, 10).
+	Budget *RetryBudget
+}
+
+// retryStatus reports whether a response status is worth retrying
+func retryStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusNotImplemented && status != http.StatusHTTPVersionNotSupported)
+}
+
+// idempotent reports whether req can safely be sent more than once
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// retryRandom is the jitter source, replaced in tests
+var retryRandom = rand.Float64
+
+// backoff returns the wait before retry number retry (starting at 1), with
+// full jitter
+func (o RetryOptions) backoff(retry int) time.Duration {
+	ceiling := float64(o.InitialBackoff) * math.Pow(2, float64(retry-1))
+	if ceiling > float64(o.MaxBackoff) {
+		ceiling = float64(o.MaxBackoff)
+	}
+	return time.Duration(retryRandom() * ceiling)
+}
+
+// Retry retries idempotent requests (GET, HEAD, OPTIONS, TRACE, PUT, DELETE,
+// or any request with an Idempotency-Key header) that fail with a connection
+// error, a 429, or a 5xx other than 501 and 505. Retries wait with
+// exponential backoff and full jitter, or as long as a Retry-After header
+// asks. Requests with a body are only retried if GetBody is set, as it is by
+// http.NewRequest for common body types. A retry is skipped if the wait
+// would pass the request context's deadline, or if the retry budget is
+// spent. The following metrics are added:
+//
+//	# Counter
+//	http_client_retry{"sha", "method", "host", "reason"}
+//	# Counter
+//	http_client_retry_budget_exhausted{"sha", "method", "host"}
+//	# Histogram
+//	http_client_request_attempts{"sha", "method", "host"}
+//
+// To log and count every attempt, place Retry outside Logging and Instrument:
+//
+//	httpclient.New(httpclient.Options{
+//		Middlewares: append([]httpclient.Middleware{httpclient.Retry(httpclient.RetryOptions{})}, httpclient.DefaultMiddlewares()...),
+//	})
+func Retry(opts RetryOptions) Middleware {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Second
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = 30 * time.Second
+	}
+	if opts.Budget == nil {
+		opts.Budget = NewRetryBudget(0.1, 10)
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			opts.Budget.deposit()
+			replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+			if !idempotent(req) || !replayable {
+				return next.RoundTrip(req)
+			}
+
+			statsdClient := middlewares.Client()
+			tags := []string{
+				fmt.Sprintf("%s:%s", "sha", version.Commit),
+				fmt.Sprintf("%s:%s", "method", strings.ToLower(req.Method)),
+				fmt.Sprintf("%s:%s", "host", req.URL.Hostname()),
+			}
+			ctx := req.Context()
+			attempt := 1
+			defer func() {
+				if statsdClient != nil {
+					statsdClient.Histogram("http_client_request_attempts", float64(attempt), tags, 1)
+				}
+			}()
+
+			for ; ; attempt++ {
+				resp, err := next.RoundTrip(req)
+
+				var reason string
+				var wait time.Duration
+				switch {
+				case err != nil:
+					if ctx.Err() != nil {
+						return resp, err
+					}
+					reason = "error"
+					wait = opts.backoff(attempt)
+				case retryStatus(resp.StatusCode):
+					reason = strconv.Itoa(resp.StatusCode)
+					wait = opts.backoff(attempt)
+					if after, ok := retryAfter(resp, time.Now()); ok {
+						if after > opts.MaxRetryAfter {
+							return resp, err
+						}
+						wait = after
+					}
+				default:
+					return resp, err
+				}
+
+				if attempt >= opts.MaxAttempts {
+					return resp, err
+				}
+				if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+					return resp, err
+				}
+				if !opts.Budget.withdraw() {
+					if statsdClient != nil {
+						statsdClient.Incr("http_client_retry_budget_exhausted", tags, 1)
+					}
+					return resp, err
+				}
+
+				retry := req
+				if req.GetBody != nil {
+					body, bodyErr := req.GetBody()
+					if bodyErr != nil {
+						return resp, err
+					}
+					retry = req.Clone(ctx)
+					retry.Body = body
+				}
+				if resp != nil {
+					// Drain the body so the connection can be reused
+					io.CopyN(io.Discard, resp.Body, 64*1024)
+					resp.Body.Close()
+				}
+				if statsdClient != nil {
+					statsdClient.Incr("http_client_retry", append(tags, fmt.Sprintf("%s:%s", "reason", reason)), 1)
+				}
+
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+				req = retry
+			}
+		})
+	}
+}
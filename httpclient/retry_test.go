@@ -0,0 +1,174 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedTransport returns the responses in statuses in order, with 0
+// meaning a connection error, and records the bodies it receives
+type scriptedTransport struct {
+	statuses   []int
+	retryAfter string
+	calls      int32
+	bodies     []string
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := int(atomic.AddInt32(&s.calls, 1)) - 1
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		s.bodies = append(s.bodies, string(body))
+	}
+	status := s.statuses[len(s.statuses)-1]
+	if call < len(s.statuses) {
+		status = s.statuses[call]
+	}
+	if status == 0 {
+		return nil, errors.New("connection reset")
+	}
+	resp := &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+	if s.retryAfter != "" {
+		resp.Header.Set("Retry-After", s.retryAfter)
+	}
+	return resp, nil
+}
+
+func TestRetry(t *testing.T) {
+	fast := RetryOptions{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	cases := []struct {
+		name       string
+		opts       RetryOptions
+		method     string
+		body       string
+		header     string
+		statuses   []int
+		retryAfter string
+		wantCalls  int32
+		wantStatus int
+		wantErr    bool
+	}{
+		{"Retry doesn't retry successes", fast, http.MethodGet, "", "", []int{200}, "", 1, 200, false},
+		{"Retry retries 503s", fast, http.MethodGet, "", "", []int{503, 200}, "", 2, 200, false},
+		{"Retry retries 429s", fast, http.MethodGet, "", "", []int{429, 200}, "", 2, 200, false},
+		{"Retry retries connection errors", fast, http.MethodGet, "", "", []int{0, 0, 200}, "", 3, 200, false},
+		{"Retry gives up after MaxAttempts", fast, http.MethodGet, "", "", []int{502}, "", 3, 502, false},
+		{"Retry returns the last error", fast, http.MethodGet, "", "", []int{0}, "", 3, 0, true},
+		{"Retry doesn't retry client errors", fast, http.MethodGet, "", "", []int{404}, "", 1, 404, false},
+		{"Retry doesn't retry 501s", fast, http.MethodGet, "", "", []int{501}, "", 1, 501, false},
+		{"Retry doesn't retry POSTs", fast, http.MethodPost, "data", "", []int{503, 200}, "", 1, 503, false},
+		{"Retry retries POSTs with an idempotency key", fast, http.MethodPost, "data", "key-1", []int{503, 200}, "", 2, 200, false},
+		{"Retry replays PUT bodies", fast, http.MethodPut, "data", "", []int{503, 200}, "", 2, 200, false},
+		{"Retry honors short Retry-After", fast, http.MethodGet, "", "", []int{503, 200}, "0", 2, 200, false},
+		{"Retry gives up on long Retry-After", fast, http.MethodGet, "", "", []int{503, 200}, "3600", 1, 503, false},
+		{"Retry stops when the budget is spent", RetryOptions{InitialBackoff: time.Millisecond, Budget: NewRetryBudget(0, 0)}, http.MethodGet, "", "", []int{503, 200}, "", 1, 503, false},
+	}
+	for _, c := range cases {
+		transport := &scriptedTransport{statuses: c.statuses, retryAfter: c.retryAfter}
+		var body *strings.Reader
+		req, _ := http.NewRequest(c.method, "http://example.com", nil)
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+			req, _ = http.NewRequest(c.method, "http://example.com", body)
+		}
+		if c.header != "" {
+			req.Header.Set("Idempotency-Key", c.header)
+		}
+
+		resp, err := Retry(c.opts)(transport).RoundTrip(req)
+		if transport.calls != c.wantCalls {
+			t.Errorf("Failed %s: expected %d calls, got %d", c.name, c.wantCalls, transport.calls)
+		}
+		if (err != nil) != c.wantErr {
+			t.Errorf("Failed %s: unexpected error %v", c.name, err)
+		}
+		if resp != nil && resp.StatusCode != c.wantStatus {
+			t.Errorf("Failed %s: expected status %d, got %d", c.name, c.wantStatus, resp.StatusCode)
+		}
+		for i, got := range transport.bodies {
+			if got != c.body {
+				t.Errorf("Failed %s: attempt %d expected body %q, got %q", c.name, i+1, c.body, got)
+			}
+		}
+	}
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	defer func(original func() float64) { retryRandom = original }(retryRandom)
+	retryRandom = func() float64 { return 0.9 }
+
+	transport := &scriptedTransport{statuses: []int{503, 200}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+
+	opts := RetryOptions{InitialBackoff: time.Second, MaxBackoff: time.Second}
+	start := time.Now()
+	resp, err := Retry(opts)(transport).RoundTrip(req)
+	if err != nil || resp.StatusCode != 503 {
+		t.Fatalf("Expected the 503 to be returned, got %v %v", resp, err)
+	}
+	// The 900ms backoff would pass the deadline, so Retry gives up at once
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("Expected Retry to give up before the deadline, took %s", elapsed)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	budget := NewRetryBudget(0.5, 1)
+	budget.now = func() time.Time { return now }
+	budget.last = now
+
+	// The minimum allows one retry a second
+	if !budget.withdraw() {
+		t.Error("Expected the minimum retry to be allowed")
+	}
+	if budget.withdraw() {
+		t.Error("Expected the budget to be spent")
+	}
+	// Two requests earn a retry
+	budget.deposit()
+	budget.deposit()
+	if !budget.withdraw() {
+		t.Error("Expected a retry earned by requests")
+	}
+	// Time earns retries
+	now = now.Add(2 * time.Second)
+	if !budget.withdraw() || !budget.withdraw() || budget.withdraw() {
+		t.Error("Expected two retries earned over two seconds")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Mon, 01 Jun 2020 12:00:10 GMT", 10 * time.Second, true},
+		{"Mon, 01 Jun 2020 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		resp := &http.Response{Header: http.Header{}}
+		if c.value != "" {
+			resp.Header.Set("Retry-After", c.value)
+		}
+		got, ok := retryAfter(resp, now)
+		if got != c.want || ok != c.wantOK {
+			t.Errorf("Failed %q: expected %s %t, got %s %t", c.value, c.want, c.wantOK, got, ok)
+		}
+	}
+}
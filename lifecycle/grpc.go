@@ -0,0 +1,112 @@
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcHealthInterval is a configuration option for this package that sets how
+// often a GrpcHealth checks Ready and Shutdown to notify Watch streams of
+// changes. Check calls always reflect the current state.
+var GrpcHealthInterval = time.Second
+
+// GrpcHealth is a grpc.health.v1 Health service that reflects Ready and
+// Shutdown. Every service, including the overall server status "", reports
+// NOT_SERVING while the application is not ready or is shutting down, and its
+// own status otherwise.
+type GrpcHealth struct {
+	*health.Server
+	mu       sync.Mutex
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// RegisterGrpcHealth registers a GrpcHealth on s, so that it can be probed by
+// tools like grpc-health-probe
+//
+//	server := grpc.NewServer()
+//	health := lifecycle.RegisterGrpcHealth(server)
+//	health.SetServingStatus("my.package.Service", healthpb.HealthCheckResponse_SERVING)
+func RegisterGrpcHealth(s *grpc.Server) *GrpcHealth {
+	g := &GrpcHealth{
+		Server: health.NewServer(),
+		statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{
+			"": healthpb.HealthCheckResponse_SERVING,
+		},
+		done: make(chan struct{}),
+	}
+	ready := serving()
+	g.apply(ready)
+	healthpb.RegisterHealthServer(s, g)
+	go g.watchLifecycle(GrpcHealthInterval, ready)
+	return g
+}
+
+func serving() bool {
+	return IsReady() && !Shutdown
+}
+
+// SetServingStatus sets the status reported for service while the application
+// is ready. Use "" for the overall server status.
+func (g *GrpcHealth) SetServingStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus) {
+	g.mu.Lock()
+	g.statuses[service] = servingStatus
+	g.mu.Unlock()
+	g.apply(serving())
+}
+
+// Check satisfies the grpc_health_v1.HealthServer interface
+func (g *GrpcHealth) Check(ctx context.Context, in *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	g.mu.Lock()
+	servingStatus, ok := g.statuses[in.Service]
+	g.mu.Unlock()
+	if !ok {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	if !serving() {
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return &healthpb.HealthCheckResponse{Status: servingStatus}, nil
+}
+
+// Stop stops watching Ready and Shutdown for changes
+func (g *GrpcHealth) Stop() {
+	g.stopOnce.Do(func() { close(g.done) })
+}
+
+// apply updates the statuses seen by Watch streams
+func (g *GrpcHealth) apply(ready bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for service, servingStatus := range g.statuses {
+		if !ready {
+			servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		g.Server.SetServingStatus(service, servingStatus)
+	}
+}
+
+func (g *GrpcHealth) watchLifecycle(interval time.Duration, last bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.done:
+			return
+		case <-ticker.C:
+			if current := serving(); current != last {
+				last = current
+				g.apply(current)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package lifecycle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcHealth(t *testing.T) {
+	formerInterval := GrpcHealthInterval
+	GrpcHealthInterval = time.Hour
+	defer func() {
+		GrpcHealthInterval = formerInterval
+		Ready = true
+		Shutdown = false
+	}()
+
+	g := RegisterGrpcHealth(grpc.NewServer())
+	defer g.Stop()
+	g.SetServingStatus("spec.Test", healthpb.HealthCheckResponse_SERVING)
+	g.SetServingStatus("spec.Broken", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	cases := []struct {
+		name       string
+		ready      bool
+		shutdown   bool
+		service    string
+		wantStatus healthpb.HealthCheckResponse_ServingStatus
+		wantCode   codes.Code
+	}{
+		{"GrpcHealth reports the server as serving", true, false, "", healthpb.HealthCheckResponse_SERVING, codes.OK},
+		{"GrpcHealth reports a serving service", true, false, "spec.Test", healthpb.HealthCheckResponse_SERVING, codes.OK},
+		{"GrpcHealth reports a service's own status", true, false, "spec.Broken", healthpb.HealthCheckResponse_NOT_SERVING, codes.OK},
+		{"GrpcHealth reports unknown services", true, false, "spec.Unknown", healthpb.HealthCheckResponse_UNKNOWN, codes.NotFound},
+		{"GrpcHealth reports not serving when not ready", false, false, "spec.Test", healthpb.HealthCheckResponse_NOT_SERVING, codes.OK},
+		{"GrpcHealth reports not serving while draining", false, true, "", healthpb.HealthCheckResponse_NOT_SERVING, codes.OK},
+	}
+	for _, c := range cases {
+		Ready = c.ready
+		Shutdown = c.shutdown
+		resp, err := g.Check(context.Background(), &healthpb.HealthCheckRequest{Service: c.service})
+		if status.Code(err) != c.wantCode {
+			t.Errorf("Failed %s: code Expected: %s, got: %s", c.name, c.wantCode, status.Code(err))
+		}
+		if resp.GetStatus() != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %s, got: %s", c.name, c.wantStatus, resp.GetStatus())
+		}
+	}
+}
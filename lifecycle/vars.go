@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 )
 
 // Shutdown is a boolean that represents whether the application has received
@@ -28,8 +29,41 @@ import (
 var Shutdown = false
 
 // Ready is a boolean that represents whether the application is ready.
+// Components that need to take the application out of rotation temporarily
+// should use MarkNotReady instead of setting it.
 var Ready = true
 
+var (
+	holdsMu sync.Mutex
+	holds   int
+)
+
+// MarkNotReady marks the application not ready until the returned release
+// function is called. Any number of components can hold the application not
+// ready at once, and it is only ready again once every hold is released and
+// Ready is true. Calling release more than once has no effect.
+func MarkNotReady() (release func()) {
+	holdsMu.Lock()
+	holds++
+	holdsMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			holdsMu.Lock()
+			holds--
+			holdsMu.Unlock()
+		})
+	}
+}
+
+// IsReady reports whether Ready is true and no MarkNotReady hold is active
+func IsReady() bool {
+	holdsMu.Lock()
+	defer holdsMu.Unlock()
+	return Ready && holds == 0
+}
+
 // ShutdownTimer is a configuration option for this package that sets the
 // amount of time in seconds an application should wait before exiting
 // after receiving a SIGTERM.
@@ -49,11 +83,11 @@ func LivenessHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(`{"status": "healthy"}`))
 }
 
-// ReadinessHandler reports on the status of Ready
+// ReadinessHandler reports on the status of IsReady
 func ReadinessHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 
-	if !Ready {
+	if !IsReady() {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		w.Write([]byte(`{"status": "not ready"}`))
 		return
@@ -0,0 +1,32 @@
+package lifecycle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMarkNotReady(t *testing.T) {
+	first := MarkNotReady()
+	second := MarkNotReady()
+	if IsReady() {
+		t.Fatal("Expected a hold to mark the application not ready")
+	}
+	first()
+	first()
+	if IsReady() {
+		t.Fatal("Expected the application to stay not ready while a hold is active")
+	}
+	second()
+	if !IsReady() {
+		t.Fatal("Expected the application to be ready once every hold was released")
+	}
+
+	recorder := httptest.NewRecorder()
+	release := MarkNotReady()
+	ReadinessHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	release()
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 while not ready, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log templates. Placeholders are written in braces:
+//
+//	{remote_addr}  client IP, see ClientIP
+//	{user}         user ID from the context, or the basic auth user
+//	{time}         start time, as 02/Jan/2006:15:04:05 -0700
+//	{time_iso}     start time, as RFC 3339
+//	{request}      request line, as "GET /path?query HTTP/1.1"
+//	{method}, {uri}, {path}, {query}, {proto}, {host}
+//	{status}       response status code
+//	{bytes}        response body bytes, "-" if none
+//	{latency}      time to handle the request, as a Go duration
+//	{latency_ms}   time to handle the request in milliseconds
+//	{request_id}   request ID from the context or X-Request-ID response header
+//	{referer}, {user_agent}
+//	{header:Name}  any request header
+//
+// Empty values are written as "-". Quotes, backslashes and non-printable
+// bytes in values are escaped as \", \\ and \xNN, as Apache's mod_log_config
+// does, so clients can't forge log lines or break the quoted fields.
+const (
+	CommonLogFormat   = `{remote_addr} - {user} [{time}] "{request}" {status} {bytes}`
+	CombinedLogFormat = CommonLogFormat + ` "{referer}" "{user_agent}"`
+	// JSONLogFormat writes each request as a JSON object with the
+	// placeholders above, other than header, as keys
+	JSONLogFormat = "json"
+)
+
+// LogSampling drops a share of successful requests from a request log.
+// Requests that fail with a 4xx or 5xx status, or take longer than
+// SlowThreshold, are always logged.
+type LogSampling struct {
+	// Rate is the fraction of successful requests that are logged, between
+	// 0 and 1. Zero logs every request.
+	Rate float64
+	// SlowThreshold is the duration above which requests are always logged
+	SlowThreshold time.Duration
+}
+
+// sampleRandom is replaced in tests
+var sampleRandom = rand.Float64
+
+func (s LogSampling) keep(status int, latency time.Duration) bool {
+	if s.Rate <= 0 || s.Rate >= 1 || status >= 400 {
+		return true
+	}
+	if s.SlowThreshold > 0 && latency >= s.SlowThreshold {
+		return true
+	}
+	return sampleRandom() < s.Rate
+}
+
+// AccessLogOptions configures the AccessLog middleware
+type AccessLogOptions struct {
+	// Format is CommonLogFormat, CombinedLogFormat, JSONLogFormat, or a
+	// custom template. Defaults to CombinedLogFormat.
+	Format string
+	// Output is where log lines are written. Defaults to os.Stdout.
+	Output io.Writer
+	// Sampling drops a share of successful requests
+	Sampling LogSampling
+}
+
+// accessLogEntry holds the values available to access log placeholders
+type accessLogEntry struct {
+	r         *http.Request
+	w         ResponseWriter
+	start     time.Time
+	latency   time.Duration
+	requestID string
+	user      string
+}
+
+var accessLogValues = map[string]func(e *accessLogEntry) string{
+	"remote_addr": func(e *accessLogEntry) string { return getRemoteAddr(e.r) },
+	"user":        func(e *accessLogEntry) string { return e.user },
+	"time":        func(e *accessLogEntry) string { return e.start.Format("02/Jan/2006:15:04:05 -0700") },
+	"time_iso":    func(e *accessLogEntry) string { return e.start.Format(time.RFC3339) },
+	"request": func(e *accessLogEntry) string {
+		return e.r.Method + " " + e.r.URL.RequestURI() + " " + e.r.Proto
+	},
+	"method": func(e *accessLogEntry) string { return e.r.Method },
+	"uri":    func(e *accessLogEntry) string { return e.r.URL.RequestURI() },
+	"path":   func(e *accessLogEntry) string { return e.r.URL.Path },
+	"query":  func(e *accessLogEntry) string { return e.r.URL.RawQuery },
+	"proto":  func(e *accessLogEntry) string { return e.r.Proto },
+	"host":   func(e *accessLogEntry) string { return e.r.Host },
+	"status": func(e *accessLogEntry) string { return codeToString(e.w.Status()) },
+	"bytes": func(e *accessLogEntry) string {
+		if e.w.BytesWritten() == 0 {
+			return ""
+		}
+		return strconv.Itoa(e.w.BytesWritten())
+	},
+	"latency": func(e *accessLogEntry) string { return e.latency.String() },
+	"latency_ms": func(e *accessLogEntry) string {
+		return strconv.FormatFloat(float64(e.latency)/float64(time.Millisecond), 'f', 3, 64)
+	},
+	"request_id": func(e *accessLogEntry) string { return e.requestID },
+	"referer":    func(e *accessLogEntry) string { return e.r.Referer() },
+	"user_agent": func(e *accessLogEntry) string { return e.r.UserAgent() },
+}
+
+// accessLogSegment is a literal string or, if value is set, a placeholder
+type accessLogSegment struct {
+	literal string
+	value   func(e *accessLogEntry) string
+}
+
+// escapeLogValue escapes quotes, backslashes and bytes outside printable
+// ASCII in value
+func escapeLogValue(value string) string {
+	clean := true
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c == '"' || c == '\\' || c < 0x20 || c > 0x7e {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return value
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&escaped, "\\x%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func parseAccessLogFormat(format string) ([]accessLogSegment, error) {
+	segments := []accessLogSegment{}
+	for format != "" {
+		open := strings.Index(format, "{")
+		if open < 0 {
+			segments = append(segments, accessLogSegment{literal: format})
+			break
+		}
+		if open > 0 {
+			segments = append(segments, accessLogSegment{literal: format[:open]})
+		}
+		end := strings.Index(format[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder in access log format %q", format)
+		}
+		name := format[open+1 : open+end]
+		format = format[open+end+1:]
+
+		if header := strings.TrimPrefix(name, "header:"); header != name {
+			segments = append(segments, accessLogSegment{value: func(e *accessLogEntry) string {
+				return e.r.Header.Get(header)
+			}})
+			continue
+		}
+		value, ok := accessLogValues[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown access log placeholder {%s}", name)
+		}
+		segments = append(segments, accessLogSegment{value: value})
+	}
+	return segments, nil
+}
+
+// AccessLog is a middleware that writes a line per request to Output in a
+// web server access log format, independently of the zap request log written
+// by Logging. It returns an error if Format is not a valid template.
+//
+//	accessLog, err := middlewares.AccessLog(middlewares.AccessLogOptions{
+//		Format: `{remote_addr} {request_id} "{request}" {status} {bytes} {latency_ms}ms`,
+//		Output: file,
+//	})
+func AccessLog(opts AccessLogOptions) (Middleware, error) {
+	if opts.Format == "" {
+		opts.Format = CombinedLogFormat
+	}
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+	var segments []accessLogSegment
+	if opts.Format != JSONLogFormat {
+		var err error
+		if segments, err = parseAccessLogFormat(opts.Format); err != nil {
+			return nil, err
+		}
+	}
+	var mu sync.Mutex
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			wrappedWriter := WrapResponseWriter(w)
+			h.ServeHTTP(wrappedWriter, r)
+
+			entry := &accessLogEntry{r: r, w: wrappedWriter, start: start, latency: time.Since(start)}
+			if !opts.Sampling.keep(wrappedWriter.Status(), entry.latency) {
+				return
+			}
+			entry.requestID, _ = RequestIDFromContext(r.Context())
+			if entry.requestID == "" {
+				// A request ID middleware applied inside AccessLog sets the
+				// context too late, but may also set the response header
+				entry.requestID = wrappedWriter.Header().Get(RequestIDHeader)
+			}
+			entry.user, _ = UserIDFromContext(r.Context())
+			if entry.user == "" {
+				entry.user, _, _ = r.BasicAuth()
+			}
+
+			var line bytes.Buffer
+			if segments == nil {
+				values := map[string]string{}
+				for name, value := range accessLogValues {
+					values[name] = value(entry)
+				}
+				json.NewEncoder(&line).Encode(values)
+			} else {
+				for _, segment := range segments {
+					if segment.value == nil {
+						line.WriteString(segment.literal)
+						continue
+					}
+					value := segment.value(entry)
+					if value == "" {
+						value = "-"
+					}
+					line.WriteString(escapeLogValue(value))
+				}
+				line.WriteByte('\n')
+			}
+
+			mu.Lock()
+			opts.Output.Write(line.Bytes())
+			mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,178 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLog(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	cases := []struct {
+		name   string
+		format string
+		want   *regexp.Regexp
+	}{
+		{
+			"AccessLog writes Common Log Format",
+			CommonLogFormat,
+			regexp.MustCompile(`^203\.0\.113\.5 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /items\?a=1 HTTP/1\.1" 201 5\n$`),
+		},
+		{
+			"AccessLog writes Combined Log Format",
+			CombinedLogFormat,
+			regexp.MustCompile(`^203\.0\.113\.5 - alice \[.+\] "POST /items\?a=1 HTTP/1\.1" 201 5 "https://example\.com/" "test-agent"\n$`),
+		},
+		{
+			"AccessLog writes custom templates",
+			`{request_id} {method} {path} {latency_ms}ms {header:X-Tenant} {header:X-Missing}`,
+			regexp.MustCompile(`^abc123 POST /items \d+\.\d{3}ms acme -\n$`),
+		},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		mw, err := AccessLog(AccessLogOptions{Format: c.format, Output: &out})
+		if err != nil {
+			t.Fatalf("Failed %s: %v", c.name, err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/items?a=1", nil)
+		req.RemoteAddr = "203.0.113.5:1234"
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("Referer", "https://example.com/")
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("X-Tenant", "acme")
+		req = req.WithContext(ContextWithRequestID(req.Context(), "abc123"))
+		mw(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		if !c.want.Match(out.Bytes()) {
+			t.Errorf("Failed %s: got %q", c.name, out.String())
+		}
+	}
+}
+
+func TestAccessLogEscaping(t *testing.T) {
+	var out bytes.Buffer
+	mw, _ := AccessLog(AccessLogOptions{Format: CombinedLogFormat, Output: &out})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("alice\n203.0.113.9 - admin", "secret")
+	req.Header.Set("User-Agent", `agent" "injected\`)
+	mw(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+
+	line := out.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Errorf("Expected a single log line, got %q", line)
+	}
+	if !strings.Contains(line, ` - alice\x0a203.0.113.9 - admin [`) {
+		t.Errorf("Expected the newline in the user to be escaped, got %q", line)
+	}
+	if !strings.HasSuffix(line, ` "agent\" \"injected\\"`+"\n") {
+		t.Errorf("Expected quotes and backslashes in the user agent to be escaped, got %q", line)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var out bytes.Buffer
+	mw, err := AccessLog(AccessLogOptions{Format: JSONLogFormat, Output: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/items", nil)
+	req = req.WithContext(ContextWithUser(req.Context(), "user-1", "org-1", false))
+	mw(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+
+	values := map[string]string{}
+	if err := json.Unmarshal(out.Bytes(), &values); err != nil {
+		t.Fatalf("Expected a JSON line, got %q: %v", out.String(), err)
+	}
+	if values["status"] != "404" || values["user"] != "user-1" || values["path"] != "/items" {
+		t.Errorf("Unexpected values %v", values)
+	}
+}
+
+func TestAccessLogInvalidFormat(t *testing.T) {
+	for _, format := range []string{"{nope}", "{status"} {
+		if _, err := AccessLog(AccessLogOptions{Format: format}); err == nil {
+			t.Errorf("Expected an error for %q", format)
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	defer func(original func() float64) { sampleRandom = original }(sampleRandom)
+	sampleRandom = func() float64 { return 0.5 }
+
+	cases := []struct {
+		name     string
+		sampling LogSampling
+		status   int
+		latency  time.Duration
+		want     bool
+	}{
+		{"LogSampling keeps everything by default", LogSampling{}, http.StatusOK, 0, true},
+		{"LogSampling drops unsampled successes", LogSampling{Rate: 0.1}, http.StatusOK, 0, false},
+		{"LogSampling keeps sampled successes", LogSampling{Rate: 0.9}, http.StatusOK, 0, true},
+		{"LogSampling keeps client errors", LogSampling{Rate: 0.1}, http.StatusNotFound, 0, true},
+		{"LogSampling keeps server errors", LogSampling{Rate: 0.1}, http.StatusBadGateway, 0, true},
+		{"LogSampling keeps slow requests", LogSampling{Rate: 0.1, SlowThreshold: time.Second}, http.StatusOK, 2 * time.Second, true},
+		{"LogSampling drops fast requests", LogSampling{Rate: 0.1, SlowThreshold: time.Second}, http.StatusOK, time.Millisecond, false},
+	}
+	for _, c := range cases {
+		if got := c.sampling.keep(c.status, c.latency); got != c.want {
+			t.Errorf("Failed %s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestLoggingSampling(t *testing.T) {
+	defer func(original func() float64) { sampleRandom = original }(sampleRandom)
+	sampleRandom = func() float64 { return 0.5 }
+
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	mw := LoggingWithOptions(LoggingOptions{Sampling: LogSampling{Rate: 0.1}})
+	mw(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	mw(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	logs := observed.TakeAll()
+	if len(logs) != 1 || logs[0].ContextMap()["status"] != int64(http.StatusNotFound) {
+		t.Errorf("Expected only the 404 to be logged, got %v", logs)
+	}
+}
+
+func TestLoggingSamplingKeepsSlowRequests(t *testing.T) {
+	defer func(original func() float64) { sampleRandom = original }(sampleRandom)
+	sampleRandom = func() float64 { return 0.5 }
+
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	mw := LoggingWithOptions(LoggingOptions{Sampling: LogSampling{Rate: 0.01}, SlowThreshold: time.Millisecond})
+	slow := mw(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { time.Sleep(2 * time.Millisecond) }))
+	for i := 0; i < 20; i++ {
+		slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	logs := observed.TakeAll()
+	if len(logs) != 20 {
+		t.Fatalf("Expected every slow request to be logged, got %d", len(logs))
+	}
+	if logs[0].Level != zapcore.WarnLevel || logs[0].ContextMap()["slow"] != true {
+		t.Errorf("Expected a slow Warn log, got %v %v", logs[0].Level, logs[0].ContextMap())
+	}
+}
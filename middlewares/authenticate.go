@@ -0,0 +1,165 @@
+package middlewares
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skuid/spec/mapvalue"
+	"go.uber.org/zap"
+)
+
+// ClaimMapping names the JWT claims holding each user value
+type ClaimMapping struct {
+	UserID    string
+	OrgID     string
+	Subdomain string
+	Admin     string
+	// Roles names a claim holding an array of roles
+	Roles string
+	// Scopes names a claim holding an array of scopes or a space separated
+	// scope string
+	Scopes string
+}
+
+// DefaultClaimMapping is used for any empty fields of AuthOptions.Claims
+var DefaultClaimMapping = ClaimMapping{
+	UserID:    "sub",
+	OrgID:     "org_id",
+	Subdomain: "subdomain",
+	Admin:     "admin",
+	Roles:     "roles",
+	Scopes:    "scope",
+}
+
+// AuthOptions configures the Authenticate middleware
+type AuthOptions struct {
+	// Keys provides the keys used to verify token signatures
+	Keys KeySet
+	// Algorithms is the list of accepted signing algorithms. Defaults to
+	// HS256, RS256 and ES256.
+	Algorithms []string
+	// Issuer, if set, must match the token's iss claim
+	Issuer string
+	// Audience, if set, must be present in the token's aud claim
+	Audience string
+	// Leeway allows for clock skew when checking exp and nbf
+	Leeway time.Duration
+	// Claims maps token claims to user values
+	Claims ClaimMapping
+	// Optional allows requests without an Authorization header through
+	// unauthenticated. Requests with an invalid token are always rejected.
+	Optional bool
+}
+
+func (opts AuthOptions) jwtOptions() jwtOptions {
+	algorithms := opts.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{HS256, RS256, ES256}
+	}
+	return jwtOptions{
+		keys:       opts.Keys,
+		algorithms: algorithms,
+		issuer:     opts.Issuer,
+		audience:   opts.Audience,
+		leeway:     opts.Leeway,
+		now:        time.Now,
+	}
+}
+
+func (m ClaimMapping) withDefaults() ClaimMapping {
+	if m.UserID == "" {
+		m.UserID = DefaultClaimMapping.UserID
+	}
+	if m.OrgID == "" {
+		m.OrgID = DefaultClaimMapping.OrgID
+	}
+	if m.Subdomain == "" {
+		m.Subdomain = DefaultClaimMapping.Subdomain
+	}
+	if m.Admin == "" {
+		m.Admin = DefaultClaimMapping.Admin
+	}
+	if m.Roles == "" {
+		m.Roles = DefaultClaimMapping.Roles
+	}
+	if m.Scopes == "" {
+		m.Scopes = DefaultClaimMapping.Scopes
+	}
+	return m
+}
+
+// IdentityFromClaims builds an Identity from verified claims using mapping.
+// All claims are kept in the Identity's Claims.
+func IdentityFromClaims(claims Claims, mapping ClaimMapping) Identity {
+	mapping = mapping.withDefaults()
+	scopes := mapvalue.StringSlice(claims, mapping.Scopes)
+	if scope := mapvalue.String(claims, mapping.Scopes); scope != "" {
+		scopes = strings.Fields(scope)
+	}
+	return Identity{
+		UserID:    mapvalue.String(claims, mapping.UserID),
+		OrgID:     mapvalue.String(claims, mapping.OrgID),
+		Subdomain: mapvalue.String(claims, mapping.Subdomain),
+		Admin:     mapvalue.Bool(claims, mapping.Admin, false) || mapvalue.String(claims, mapping.Admin) == "true",
+		Roles:     mapvalue.StringSlice(claims, mapping.Roles),
+		Scopes:    scopes,
+		Claims:    claims,
+	}
+}
+
+// ContextWithClaims places an Identity built from verified claims into a
+// context, so it is available through IdentityFromContext, UserIDFromContext
+// and friends
+func ContextWithClaims(ctx context.Context, claims Claims, mapping ClaimMapping) context.Context {
+	return ContextWithIdentity(ctx, IdentityFromClaims(claims, mapping))
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", errMissingToken
+	}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || parts[1] == "" {
+		return "", errors.New("Authorization header is not a bearer token")
+	}
+	return parts[1], nil
+}
+
+var errMissingToken = errors.New("Authorization header is missing")
+
+// Authenticate is a middleware that validates a bearer JWT from the
+// Authorization header and stores the user values from its claims in the
+// request context. Requests without a valid token receive a 401. It panics if
+// opts.Keys is nil.
+func Authenticate(opts AuthOptions) Middleware {
+	if opts.Keys == nil {
+		panic("middlewares: Authenticate requires AuthOptions.Keys")
+	}
+	jwtOpts := opts.jwtOptions()
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := bearerToken(r)
+			if err == errMissingToken && opts.Optional {
+				h.ServeHTTP(w, r)
+				return
+			}
+			var claims Claims
+			if err == nil {
+				claims, err = verifyJWT(token, jwtOpts)
+			}
+			if err != nil {
+				zap.L().Info("Authentication failed", zap.String("path", r.URL.Path), zap.Error(err))
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "unauthorized"}`))
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(ContextWithClaims(r.Context(), claims, opts.Claims)))
+		})
+	}
+}
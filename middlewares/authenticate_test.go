@@ -0,0 +1,269 @@
+package middlewares
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, alg string, kid string, key interface{}, claims Claims) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case RS256:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("Unable to sign token: %v", err)
+		}
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatalf("Unable to sign token: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	opts := AuthOptions{
+		Keys: StaticKeySet{
+			"hs": secret,
+			"rs": &rsaKey.PublicKey,
+			"es": &ecKey.PublicKey,
+		},
+		Issuer:   "https://auth.skuid.com",
+		Audience: "spec",
+		Leeway:   time.Minute,
+		Claims:   ClaimMapping{OrgID: "site"},
+	}
+	valid := func(overrides Claims) Claims {
+		claims := Claims{
+			"sub":       "user1",
+			"site":      "org1",
+			"subdomain": "acme",
+			"admin":     true,
+			"iss":       "https://auth.skuid.com",
+			"aud":       []string{"other", "spec"},
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	cases := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantUserID    string
+	}{
+		{
+			"Authenticate accepts HS256",
+			"Bearer " + signTestJWT(t, HS256, "hs", secret, valid(nil)),
+			http.StatusOK,
+			"user1",
+		},
+		{
+			"Authenticate accepts RS256",
+			"Bearer " + signTestJWT(t, RS256, "rs", rsaKey, valid(nil)),
+			http.StatusOK,
+			"user1",
+		},
+		{
+			"Authenticate accepts ES256",
+			"Bearer " + signTestJWT(t, ES256, "es", ecKey, valid(nil)),
+			http.StatusOK,
+			"user1",
+		},
+		{
+			"Authenticate allows expiry within leeway",
+			"Bearer " + signTestJWT(t, HS256, "hs", secret, valid(Claims{"exp": time.Now().Add(-30 * time.Second).Unix()})),
+			http.StatusOK,
+			"user1",
+		},
+		{
+			"Authenticate rejects a missing token",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Authenticate rejects an expired token",
+			"Bearer " + signTestJWT(t, HS256, "hs", secret, valid(Claims{"exp": time.Now().Add(-time.Hour).Unix()})),
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Authenticate rejects the wrong issuer",
+			"Bearer " + signTestJWT(t, HS256, "hs", secret, valid(Claims{"iss": "https://evil.com"})),
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Authenticate rejects the wrong audience",
+			"Bearer " + signTestJWT(t, HS256, "hs", secret, valid(Claims{"aud": "other"})),
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Authenticate rejects a bad signature",
+			"Bearer " + signTestJWT(t, HS256, "hs", []byte("wrong"), valid(nil)),
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Authenticate rejects an algorithm that doesn't match the key",
+			"Bearer " + signTestJWT(t, HS256, "rs", secret, valid(nil)),
+			http.StatusUnauthorized,
+			"",
+		},
+	}
+	for _, c := range cases {
+		var gotUserID, gotOrgID, gotSubdomain string
+		var gotAdmin bool
+		handler := Authenticate(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotUserID, _ = UserIDFromContext(r.Context())
+			gotOrgID, _ = OrgIDFromContext(r.Context())
+			gotSubdomain, _ = SubdomainFromContext(r.Context())
+			gotAdmin = IsAdminFromContext(r.Context())
+		}))
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.authorization != "" {
+			request.Header.Set("Authorization", c.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		if gotUserID != c.wantUserID {
+			t.Errorf("Failed %s: userID Expected: %q, got: %q", c.name, c.wantUserID, gotUserID)
+		}
+		if c.wantStatus == http.StatusOK && (gotOrgID != "org1" || gotSubdomain != "acme" || !gotAdmin) {
+			t.Errorf("Failed %s: Unexpected user values %q %q %v", c.name, gotOrgID, gotSubdomain, gotAdmin)
+		}
+	}
+}
+
+func TestJWKSKeySet(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": "k1", "use": "sig", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		)
+	}))
+	defer server.Close()
+
+	handler := Authenticate(AuthOptions{Keys: NewJWKSKeySet(server.URL, time.Hour)})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	token := signTestJWT(t, RS256, "k1", rsaKey, Claims{"sub": "user1", "exp": time.Now().Add(time.Hour).Unix()})
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got: %d", http.StatusOK, recorder.Code)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected JWKS to be fetched once, got %d fetches", requests)
+	}
+}
+
+func TestJWKSKeySetRefreshFailures(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var requests int32
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "kid": "k1", "use": "sig", "n": %q, "e": %q}]}`,
+			base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	keys := NewJWKSKeySet(server.URL, 0)
+	keys.now = func() time.Time { return now }
+	if _, err := keys.Key("k1", RS256); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Key("k1", RS256); err != nil || requests != 1 {
+		t.Fatalf("Expected a zero TTL to cache keys, got %d fetches and %v", requests, err)
+	}
+
+	// After the TTL, a failing source is tried once a minute and the cached
+	// keys are still served
+	atomic.StoreInt32(&failing, 1)
+	now = now.Add(2 * time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := keys.Key("k1", RS256); err != nil {
+				t.Errorf("Expected the cached key, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("Expected a single refresh attempt, got %d fetches", got-1)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	now = now.Add(time.Minute)
+	keys.Key("k1", RS256)
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Expected a retry after a minute, got %d fetches", got)
+	}
+}
+
+func TestAuthenticateRequiresKeys(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected Authenticate to panic without Keys")
+		}
+	}()
+	Authenticate(AuthOptions{})
+}
@@ -0,0 +1,160 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// AccessPolicy decides whether the identity making a request is allowed to
+// make it. It returns nil to allow the request, or an error describing why the
+// request was denied.
+type AccessPolicy func(r *http.Request, identity Identity) error
+
+var errUnauthenticated = errors.New("User is not stored in request context")
+
+// AdminPolicy allows admin users
+func AdminPolicy() AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		if !identity.Admin {
+			return errors.New("user is not an admin")
+		}
+		return nil
+	}
+}
+
+// RolePolicy allows users with any of the given roles
+func RolePolicy(roles ...string) AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		for _, role := range roles {
+			if identity.HasRole(role) {
+				return nil
+			}
+		}
+		return fmt.Errorf("user has none of the roles %s", strings.Join(roles, ", "))
+	}
+}
+
+// ScopePolicy allows users with all of the given scopes
+func ScopePolicy(scopes ...string) AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		for _, scope := range scopes {
+			if !identity.HasScope(scope) {
+				return fmt.Errorf("user is missing the scope %s", scope)
+			}
+		}
+		return nil
+	}
+}
+
+// OrgMatchPolicy allows users whose org ID matches the one extracted from the
+// request, typically a path parameter. For example, with gorilla/mux:
+//
+//	OrgMatchPolicy(func(r *http.Request) string { return mux.Vars(r)["orgId"] })
+func OrgMatchPolicy(extract func(*http.Request) string) AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		orgID := extract(r)
+		if orgID == "" {
+			return errors.New("request has no org ID")
+		}
+		if identity.OrgID != orgID {
+			return fmt.Errorf("user org %q does not match requested org %q", identity.OrgID, orgID)
+		}
+		return nil
+	}
+}
+
+// PathSegment returns a function extracting the path segment at index from a
+// request, for use with OrgMatchPolicy. For "/orgs/123/users", index 1 is
+// "123".
+func PathSegment(index int) func(*http.Request) string {
+	return func(r *http.Request) string {
+		segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if index < 0 || index >= len(segments) {
+			return ""
+		}
+		return segments[index]
+	}
+}
+
+// AnyPolicy allows requests allowed by at least one of policies
+func AnyPolicy(policies ...AccessPolicy) AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		reasons := make([]string, 0, len(policies))
+		for _, policy := range policies {
+			err := policy(r, identity)
+			if err == nil {
+				return nil
+			}
+			reasons = append(reasons, err.Error())
+		}
+		return fmt.Errorf("no policy allowed the request: %s", strings.Join(reasons, "; "))
+	}
+}
+
+// AllPolicy allows requests allowed by every one of policies
+func AllPolicy(policies ...AccessPolicy) AccessPolicy {
+	return func(r *http.Request, identity Identity) error {
+		for _, policy := range policies {
+			if err := policy(r, identity); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Authorize is a middleware that checks policy against the Identity stored in
+// the request context. Requests without an Identity receive a 401, and
+// requests denied by policy receive a 403. Denials are logged with their
+// reason.
+func Authorize(policy AccessPolicy) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := IdentityFromContext(r.Context())
+			if err != nil {
+				err = errUnauthenticated
+			} else {
+				err = policy(r, identity)
+			}
+			if err == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			fields := []zap.Field{
+				zap.String("path", r.URL.Path),
+				zap.String("method", r.Method),
+				zap.String("reason", err.Error()),
+			}
+			zap.L().Info("Authorization denied", append(fields, contextFields(r.Context())...)...)
+
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			if err == errUnauthenticated {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": "unauthorized"}`))
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "forbidden"}`))
+		})
+	}
+}
+
+// RequireAdmin is a middleware that only allows admin users
+func RequireAdmin() Middleware {
+	return Authorize(AdminPolicy())
+}
+
+// RequireRole is a middleware that only allows users with any of the given roles
+func RequireRole(roles ...string) Middleware {
+	return Authorize(RolePolicy(roles...))
+}
+
+// RequireScope is a middleware that only allows users with all of the given scopes
+func RequireScope(scopes ...string) Middleware {
+	return Authorize(ScopePolicy(scopes...))
+}
@@ -0,0 +1,83 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAuthorize(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	editor := &Identity{UserID: "user1", OrgID: "org1", Roles: []string{"editor"}, Scopes: []string{"read"}}
+	admin := &Identity{UserID: "user2", OrgID: "org2", Admin: true}
+
+	cases := []struct {
+		name       string
+		middleware Middleware
+		identity   *Identity
+		path       string
+		wantStatus int
+	}{
+		{"RequireAdmin rejects unauthenticated requests", RequireAdmin(), nil, "/", http.StatusUnauthorized},
+		{"RequireAdmin rejects non-admins", RequireAdmin(), editor, "/", http.StatusForbidden},
+		{"RequireAdmin allows admins", RequireAdmin(), admin, "/", http.StatusOK},
+		{"RequireRole allows any matching role", RequireRole("viewer", "editor"), editor, "/", http.StatusOK},
+		{"RequireRole rejects missing roles", RequireRole("viewer"), editor, "/", http.StatusForbidden},
+		{"RequireScope requires every scope", RequireScope("read", "write"), editor, "/", http.StatusForbidden},
+		{"RequireScope allows matching scopes", RequireScope("read"), editor, "/", http.StatusOK},
+		{
+			"OrgMatchPolicy allows a matching org",
+			Authorize(OrgMatchPolicy(PathSegment(1))),
+			editor,
+			"/orgs/org1/users",
+			http.StatusOK,
+		},
+		{
+			"OrgMatchPolicy rejects another org",
+			Authorize(OrgMatchPolicy(PathSegment(1))),
+			editor,
+			"/orgs/org2/users",
+			http.StatusForbidden,
+		},
+		{
+			"AnyPolicy lets admins through an org match",
+			Authorize(AnyPolicy(AdminPolicy(), OrgMatchPolicy(PathSegment(1)))),
+			admin,
+			"/orgs/org1/users",
+			http.StatusOK,
+		},
+		{
+			"AllPolicy requires every policy",
+			Authorize(AllPolicy(RolePolicy("editor"), OrgMatchPolicy(PathSegment(1)))),
+			editor,
+			"/orgs/org2/users",
+			http.StatusForbidden,
+		},
+	}
+	for _, c := range cases {
+		observed.TakeAll()
+		handler := c.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		request := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.identity != nil {
+			request = request.WithContext(ContextWithIdentity(context.Background(), *c.identity))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		logs := observed.TakeAll()
+		if c.wantStatus != http.StatusOK && (len(logs) != 1 || logs[0].ContextMap()["reason"] == "") {
+			t.Errorf("Failed %s: Expected a denial log with a reason, got: %v", c.name, logs)
+		}
+	}
+}
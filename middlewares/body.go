@@ -0,0 +1,112 @@
+package middlewares
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// limitedBody wraps an http.MaxBytesReader, recording whether the limit was
+// exceeded
+type limitedBody struct {
+	io.ReadCloser
+	mu       sync.Mutex
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		b.mu.Lock()
+		b.exceeded = true
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *limitedBody) limitExceeded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exceeded
+}
+
+func writeBodyTooLarge(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(`{"error": "request body too large"}`))
+}
+
+// LimitBody is a middleware that limits request bodies to maxBytes. Requests
+// declaring a larger Content-Length are rejected with a 413 before the
+// handler runs. Other bodies are wrapped with http.MaxBytesReader, so reads
+// past the limit fail with an *http.MaxBytesError; if the handler then
+// returns without writing a response, the 413 is written for it.
+func LimitBody(maxBytes int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				writeBodyTooLarge(w)
+				return
+			}
+			if r.Body == nil || r.Body == http.NoBody {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBytes)}
+			r.Body = body
+			wrappedWriter := WrapResponseWriter(w)
+			h.ServeHTTP(wrappedWriter, r)
+			if body.limitExceeded() && !wrappedWriter.WroteHeader() {
+				writeBodyTooLarge(w)
+			}
+		})
+	}
+}
+
+// RequireContentType is a middleware that rejects requests with a body whose
+// Content-Type is not one of types with a 415. Types are media types without
+// parameters, such as "application/json", a wildcard subtype such as
+// "text/*", or a structured syntax suffix such as "application/*+json".
+func RequireContentType(types ...string) Middleware {
+	allowed := make([]string, len(types))
+	for i, t := range types {
+		allowed[i] = strings.ToLower(t)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+				h.ServeHTTP(w, r)
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err == nil && contentTypeAllowed(allowed, mediaType) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte(`{"error": "unsupported content type"}`))
+		})
+	}
+}
+
+func contentTypeAllowed(allowed []string, mediaType string) bool {
+	for _, t := range allowed {
+		if t == mediaType {
+			return true
+		}
+		if i := strings.Index(t, "/*"); i >= 0 {
+			prefix, suffix := t[:i+1], t[i+2:]
+			if strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType[len(prefix):], suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
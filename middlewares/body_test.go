@@ -0,0 +1,124 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLimitBody(t *testing.T) {
+	// The handler echoes the body, or ignores a failed read if asked to
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if r.Header.Get("X-Handle-Error") != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("handled"))
+			}
+			return
+		}
+		w.Write(body)
+	}
+
+	cases := []struct {
+		name          string
+		body          string
+		unknownLength bool
+		handleError   bool
+		wantStatus    int
+		wantBody      string
+	}{
+		{
+			"LimitBody passes through small bodies",
+			"hello",
+			false,
+			false,
+			http.StatusOK,
+			"hello",
+		},
+		{
+			"LimitBody rejects a large Content-Length",
+			"hello world",
+			false,
+			false,
+			http.StatusRequestEntityTooLarge,
+			`{"error": "request body too large"}`,
+		},
+		{
+			"LimitBody rejects a large body of unknown length",
+			"hello world",
+			true,
+			false,
+			http.StatusRequestEntityTooLarge,
+			`{"error": "request body too large"}`,
+		},
+		{
+			"LimitBody leaves the response to handlers that write one",
+			"hello world",
+			true,
+			true,
+			http.StatusBadRequest,
+			"handled",
+		},
+	}
+	for _, c := range cases {
+		var body io.Reader = strings.NewReader(c.body)
+		if c.unknownLength {
+			body = io.NopCloser(body)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		if c.handleError {
+			req.Header.Set("X-Handle-Error", "true")
+		}
+		w := httptest.NewRecorder()
+		LimitBody(8)(http.HandlerFunc(handler)).ServeHTTP(w, req)
+
+		if w.Code != c.wantStatus {
+			t.Errorf("Failed %s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+		}
+		if got := w.Body.String(); got != c.wantBody {
+			t.Errorf("Failed %s: expected body %q, got %q", c.name, c.wantBody, got)
+		}
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mw := RequireContentType("application/json", "text/*")
+
+	cases := []struct {
+		name        string
+		method      string
+		body        string
+		contentType string
+		wantStatus  int
+	}{
+		{"RequireContentType allows an exact match", http.MethodPost, "{}", "application/json", http.StatusNoContent},
+		{"RequireContentType ignores parameters", http.MethodPost, "{}", "application/json; charset=utf-8", http.StatusNoContent},
+		{"RequireContentType ignores case", http.MethodPost, "{}", "Application/JSON", http.StatusNoContent},
+		{"RequireContentType allows wildcard subtypes", http.MethodPut, "hi", "text/plain", http.StatusNoContent},
+		{"RequireContentType rejects other types", http.MethodPost, "a=b", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"RequireContentType rejects a missing type", http.MethodPost, "{}", "", http.StatusUnsupportedMediaType},
+		{"RequireContentType allows requests without a body", http.MethodGet, "", "", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		var body io.Reader
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+		}
+		req := httptest.NewRequest(c.method, "/", body)
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		w := httptest.NewRecorder()
+		mw(handler).ServeHTTP(w, req)
+
+		if w.Code != c.wantStatus {
+			t.Errorf("Failed %s: expected status %d, got %d", c.name, c.wantStatus, w.Code)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RedactedValue replaces the values removed by RedactFields
+const RedactedValue = "[REDACTED]"
+
+// DefaultCaptureContentTypes are the media types captured when
+// BodyCaptureOptions.ContentTypes is empty. Other types are assumed to be
+// binary.
+var DefaultCaptureContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/x-www-form-urlencoded",
+}
+
+// BodyCaptureOptions configures capture of request and response bodies by
+// Logging. Bodies may hold credentials and personal data, so capture should
+// be limited to debugging and paired with a Redact function. Bodies with a
+// Content-Encoding, such as responses compressed by a Compress middleware
+// inside Logging, aren't logged; a request_body_encoding or
+// response_body_encoding field names the encoding instead.
+type BodyCaptureOptions struct {
+	// OnDebug captures the bodies of every request while the global logger
+	// has debug logging enabled
+	OnDebug bool
+	// Header, if set, captures the bodies of requests that have the header
+	// with any value
+	Header string
+	// SampleRate is the fraction of other requests whose bodies are
+	// captured, between 0 and 1
+	SampleRate float64
+	// MaxBytes is the number of bytes captured from each body. Defaults to
+	// 4096.
+	MaxBytes int
+	// ContentTypes are the media types that are captured, in the same forms
+	// accepted by RequireContentType. Defaults to DefaultCaptureContentTypes.
+	ContentTypes []string
+	// Redact, if set, is applied to each captured body before it is logged,
+	// with the body's media type
+	Redact func(mediaType string, body []byte) []byte
+}
+
+func (o *BodyCaptureOptions) withDefaults() *BodyCaptureOptions {
+	if o == nil {
+		return nil
+	}
+	opts := *o
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 4096
+	}
+	if len(opts.ContentTypes) == 0 {
+		opts.ContentTypes = DefaultCaptureContentTypes
+	}
+	contentTypes := make([]string, len(opts.ContentTypes))
+	for i, t := range opts.ContentTypes {
+		contentTypes[i] = strings.ToLower(t)
+	}
+	opts.ContentTypes = contentTypes
+	return &opts
+}
+
+// enabled reports whether bodies should be captured for r
+func (o *BodyCaptureOptions) enabled(r *http.Request) bool {
+	if o == nil {
+		return false
+	}
+	if o.OnDebug && zap.L().Core().Enabled(zapcore.DebugLevel) {
+		return true
+	}
+	if o.Header != "" && r.Header.Get(o.Header) != "" {
+		return true
+	}
+	return o.SampleRate > 0 && sampleRandom() < o.SampleRate
+}
+
+// fields returns the log fields for a captured body, or none if the body is
+// empty or not a captured content type. Encoded bodies are replaced by their
+// encoding.
+func (o *BodyCaptureOptions) fields(key string, header http.Header, capture *bodyCapture) []zapcore.Field {
+	body, truncated := capture.bytes()
+	if len(body) == 0 {
+		return nil
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return []zapcore.Field{zap.String(key+"_encoding", encoding)}
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !contentTypeAllowed(o.ContentTypes, mediaType) {
+		return nil
+	}
+	if o.Redact != nil {
+		body = o.Redact(mediaType, body)
+	}
+	fields := []zapcore.Field{zap.ByteString(key, body)}
+	if truncated {
+		fields = append(fields, zap.Bool(key+"_truncated", true))
+	}
+	return fields
+}
+
+// bodyCapture keeps the first max bytes written to it
+type bodyCapture struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+// writer returns c as an io.Writer, or nil if c is nil
+func (c *bodyCapture) writer() io.Writer {
+	if c == nil {
+		return nil
+	}
+	return c
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if remaining := c.max - c.buf.Len(); len(p) > remaining {
+		c.buf.Write(p[:remaining])
+		c.truncated = true
+	} else {
+		c.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+func (c *bodyCapture) bytes() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.buf.Bytes()...), c.truncated
+}
+
+// RedactFields returns a BodyCaptureOptions.Redact function that replaces the
+// values of the named fields, at any depth and in any case, with
+// RedactedValue in JSON and form bodies. Bodies of those types that can't be
+// parsed, including truncated JSON, are replaced entirely, since sensitive
+// values can't be found in them.
+func RedactFields(names ...string) func(mediaType string, body []byte) []byte {
+	redact := map[string]bool{}
+	for _, name := range names {
+		redact[strings.ToLower(name)] = true
+	}
+	return func(mediaType string, body []byte) []byte {
+		switch {
+		case mediaType == "application/x-www-form-urlencoded":
+			values, err := url.ParseQuery(string(body))
+			if err != nil {
+				return []byte(RedactedValue)
+			}
+			for key := range values {
+				if redact[strings.ToLower(key)] {
+					values[key] = []string{RedactedValue}
+				}
+			}
+			return []byte(values.Encode())
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			var value interface{}
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			decoder.UseNumber()
+			if err := decoder.Decode(&value); err != nil {
+				return []byte(RedactedValue)
+			}
+			redacted, err := json.Marshal(redactJSON(value, redact))
+			if err != nil {
+				return []byte(RedactedValue)
+			}
+			return redacted
+		default:
+			return body
+		}
+	}
+}
+
+func redactJSON(value interface{}, redact map[string]bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if redact[strings.ToLower(key)] {
+				v[key] = RedactedValue
+			} else {
+				v[key] = redactJSON(child, redact)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactJSON(child, redact)
+		}
+	}
+	return value
+}
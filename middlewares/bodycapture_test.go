@@ -0,0 +1,216 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLoggingBodyCapture(t *testing.T) {
+	defer func(original func() float64) { sampleRandom = original }(sampleRandom)
+	sampleRandom = func() float64 { return 0.5 }
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(`{"token": "abc", "ok": true}`))
+	})
+
+	cases := []struct {
+		name         string
+		level        zapcore.Level
+		capture      *BodyCaptureOptions
+		header       string
+		responseType string
+		wantRequest  interface{}
+		wantResponse interface{}
+		wantTrunc    bool
+	}{
+		{
+			"Logging doesn't capture bodies by default",
+			zapcore.DebugLevel,
+			nil,
+			"",
+			"application/json",
+			nil,
+			nil,
+			false,
+		},
+		{
+			"Logging captures bodies at debug level",
+			zapcore.DebugLevel,
+			&BodyCaptureOptions{OnDebug: true},
+			"",
+			"application/json",
+			`{"password": "hunter2", "name": "alice"}`,
+			`{"token": "abc", "ok": true}`,
+			false,
+		},
+		{
+			"Logging doesn't capture bodies above debug level",
+			zapcore.InfoLevel,
+			&BodyCaptureOptions{OnDebug: true},
+			"",
+			"application/json",
+			nil,
+			nil,
+			false,
+		},
+		{
+			"Logging captures bodies by header",
+			zapcore.InfoLevel,
+			&BodyCaptureOptions{Header: "X-Debug-Body"},
+			"X-Debug-Body",
+			"application/json",
+			`{"password": "hunter2", "name": "alice"}`,
+			`{"token": "abc", "ok": true}`,
+			false,
+		},
+		{
+			"Logging captures sampled bodies",
+			zapcore.InfoLevel,
+			&BodyCaptureOptions{SampleRate: 0.9},
+			"",
+			"application/json",
+			`{"password": "hunter2", "name": "alice"}`,
+			`{"token": "abc", "ok": true}`,
+			false,
+		},
+		{
+			"Logging doesn't capture unsampled bodies",
+			zapcore.InfoLevel,
+			&BodyCaptureOptions{SampleRate: 0.1},
+			"",
+			"application/json",
+			nil,
+			nil,
+			false,
+		},
+		{
+			"Logging skips binary bodies",
+			zapcore.DebugLevel,
+			&BodyCaptureOptions{OnDebug: true},
+			"",
+			"application/octet-stream",
+			`{"password": "hunter2", "name": "alice"}`,
+			nil,
+			false,
+		},
+		{
+			"Logging redacts bodies",
+			zapcore.DebugLevel,
+			&BodyCaptureOptions{OnDebug: true, Redact: RedactFields("password", "token")},
+			"",
+			"application/json",
+			`{"name":"alice","password":"[REDACTED]"}`,
+			`{"ok":true,"token":"[REDACTED]"}`,
+			false,
+		},
+		{
+			"Logging truncates bodies",
+			zapcore.DebugLevel,
+			&BodyCaptureOptions{OnDebug: true, MaxBytes: 10},
+			"",
+			"application/json",
+			`{"password`,
+			`{"token": `,
+			true,
+		},
+	}
+	for _, c := range cases {
+		core, observed := observer.New(c.level)
+		reset := zap.ReplaceGlobals(zap.New(core))
+
+		req := httptest.NewRequest(http.MethodPost, "/?type="+c.responseType, strings.NewReader(`{"password": "hunter2", "name": "alice"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if c.header != "" {
+			req.Header.Set(c.header, "true")
+		}
+		LoggingWithOptions(LoggingOptions{BodyCapture: c.capture})(handler).ServeHTTP(httptest.NewRecorder(), req)
+		reset()
+
+		logs := observed.TakeAll()
+		if len(logs) != 1 {
+			t.Fatalf("Failed %s: expected 1 log, got %d", c.name, len(logs))
+		}
+		fields := logs[0].ContextMap()
+		if got := fields["request_body"]; got != c.wantRequest {
+			t.Errorf("Failed %s: expected request_body %v, got %v", c.name, c.wantRequest, got)
+		}
+		if got := fields["response_body"]; got != c.wantResponse {
+			t.Errorf("Failed %s: expected response_body %v, got %v", c.name, c.wantResponse, got)
+		}
+		if _, got := fields["response_body_truncated"]; got != c.wantTrunc {
+			t.Errorf("Failed %s: expected response_body_truncated %v", c.name, c.wantTrunc)
+		}
+	}
+}
+
+func TestLoggingBodyCaptureEncoded(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok": true}`))
+	})
+	logging := LoggingWithOptions(LoggingOptions{BodyCapture: &BodyCaptureOptions{OnDebug: true}})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	Apply(handler, Compress(CompressOptions{MinSize: 1}), logging).ServeHTTP(httptest.NewRecorder(), req)
+
+	fields := observed.TakeAll()[0].ContextMap()
+	if _, ok := fields["response_body"]; ok {
+		t.Errorf("Expected the compressed body not to be logged, got %q", fields["response_body"])
+	}
+	if fields["response_body_encoding"] != "gzip" {
+		t.Errorf("Expected response_body_encoding gzip, got %v", fields["response_body_encoding"])
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	redact := RedactFields("password", "Secret")
+	cases := []struct {
+		name      string
+		mediaType string
+		body      string
+		want      string
+	}{
+		{
+			"RedactFields redacts nested JSON",
+			"application/json",
+			`{"user": {"PASSWORD": "x", "items": [{"secret": 1}]}, "id": 12345678901234567890}`,
+			`{"id":12345678901234567890,"user":{"PASSWORD":"[REDACTED]","items":[{"secret":"[REDACTED]"}]}}`,
+		},
+		{
+			"RedactFields redacts forms",
+			"application/x-www-form-urlencoded",
+			"password=x&name=alice",
+			"name=alice&password=%5BREDACTED%5D",
+		},
+		{
+			"RedactFields replaces unparseable JSON",
+			"application/problem+json",
+			`{"password": "x`,
+			"[REDACTED]",
+		},
+		{
+			"RedactFields leaves other types",
+			"text/plain",
+			"password=x",
+			"password=x",
+		},
+	}
+	for _, c := range cases {
+		if got := string(redact(c.mediaType, []byte(c.body))); got != c.want {
+			t.Errorf("Failed %s: expected %s, got %s", c.name, c.want, got)
+		}
+	}
+}
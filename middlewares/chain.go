@@ -0,0 +1,130 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Chain is an immutable list of middlewares, listed outermost first. The
+// first middleware in a Chain sees the request first, which is the opposite
+// of Apply.
+//
+//	base := middlewares.NewChain(middlewares.Logging(), middlewares.Recover())
+//	mux.Handle("/api/", base.Append(middlewares.Authenticate(opts)).Then(api))
+//	mux.Handle("/static/", base.Then(static))
+type Chain struct {
+	middlewares []Middleware
+}
+
+// NewChain returns a Chain of middlewares, listed outermost first
+func NewChain(middlewares ...Middleware) Chain {
+	return Chain{middlewares: append([]Middleware{}, middlewares...)}
+}
+
+// Append returns a new Chain with middlewares added inside of c's
+func (c Chain) Append(middlewares ...Middleware) Chain {
+	combined := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	combined = append(combined, c.middlewares...)
+	return Chain{middlewares: append(combined, middlewares...)}
+}
+
+// Prepend returns a new Chain with middlewares added outside of c's
+func (c Chain) Prepend(middlewares ...Middleware) Chain {
+	combined := make([]Middleware, 0, len(c.middlewares)+len(middlewares))
+	combined = append(combined, middlewares...)
+	return Chain{middlewares: append(combined, c.middlewares...)}
+}
+
+// Extend returns a new Chain with the middlewares of other added inside of
+// c's
+func (c Chain) Extend(other Chain) Chain {
+	return c.Append(other.middlewares...)
+}
+
+// Then wraps h in the chain's middlewares and returns it. A nil h uses
+// http.DefaultServeMux.
+func (c Chain) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		h = c.middlewares[i](h)
+	}
+	return h
+}
+
+// ThenFunc is Then for an http.HandlerFunc
+func (c Chain) ThenFunc(fn http.HandlerFunc) http.Handler {
+	if fn == nil {
+		return c.Then(nil)
+	}
+	return c.Then(fn)
+}
+
+// Middleware returns the chain as a single Middleware, so it can be used
+// with Apply or nested in another Chain
+func (c Chain) Middleware() Middleware {
+	return func(h http.Handler) http.Handler {
+		return c.Then(h)
+	}
+}
+
+// Handle registers h on mux for pattern, wrapped in the chain's middlewares.
+// The pattern is recorded as the request's route with Route.
+func (c Chain) Handle(mux *http.ServeMux, pattern string, h http.Handler) {
+	mux.Handle(pattern, c.Append(Route(pattern)).Then(h))
+}
+
+// HandleFunc registers fn on mux for pattern, wrapped in the chain's
+// middlewares. The pattern is recorded as the request's route with Route.
+func (c Chain) HandleFunc(mux *http.ServeMux, pattern string, fn http.HandlerFunc) {
+	c.Handle(mux, pattern, fn)
+}
+
+// RequestPredicate reports whether a request matches a condition
+type RequestPredicate func(*http.Request) bool
+
+// When returns a middleware that applies mw only to requests matching
+// predicate. Other requests go straight to the wrapped handler.
+func When(predicate RequestPredicate, mw Middleware) Middleware {
+	return func(h http.Handler) http.Handler {
+		wrapped := mw(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if predicate(r) {
+				wrapped.ServeHTTP(w, r)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Unless returns a middleware that applies mw only to requests that don't
+// match predicate
+func Unless(predicate RequestPredicate, mw Middleware) Middleware {
+	return When(func(r *http.Request) bool { return !predicate(r) }, mw)
+}
+
+// PathPrefix matches requests whose path starts with any of prefixes
+func PathPrefix(prefixes ...string) RequestPredicate {
+	return func(r *http.Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Methods matches requests with any of methods
+func Methods(methods ...string) RequestPredicate {
+	return func(r *http.Request) bool {
+		for _, method := range methods {
+			if r.Method == method {
+				return true
+			}
+		}
+		return false
+	}
+}
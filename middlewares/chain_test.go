@@ -0,0 +1,134 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// tagMiddleware appends name to the X-Order header on the way in
+func tagMiddleware(name string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Add("X-Order", name)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func orderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(strings.Join(r.Header.Values("X-Order"), ",")))
+}
+
+func TestChain(t *testing.T) {
+	base := NewChain(tagMiddleware("a"), tagMiddleware("b"))
+
+	cases := []struct {
+		name    string
+		handler http.Handler
+		want    string
+	}{
+		{
+			"Then runs middlewares outermost first",
+			base.ThenFunc(orderHandler),
+			"a,b",
+		},
+		{
+			"Append adds inner middlewares",
+			base.Append(tagMiddleware("c")).ThenFunc(orderHandler),
+			"a,b,c",
+		},
+		{
+			"Prepend adds outer middlewares",
+			base.Prepend(tagMiddleware("c")).ThenFunc(orderHandler),
+			"c,a,b",
+		},
+		{
+			"Extend adds another chain inside",
+			base.Extend(NewChain(tagMiddleware("c"), tagMiddleware("d"))).ThenFunc(orderHandler),
+			"a,b,c,d",
+		},
+		{
+			"Chains are not modified by Append",
+			base.ThenFunc(orderHandler),
+			"a,b",
+		},
+		{
+			"Middleware nests a chain in Apply",
+			Apply(http.HandlerFunc(orderHandler), base.Middleware(), tagMiddleware("c")),
+			"c,a,b",
+		},
+		{
+			"Apply runs the last middleware first",
+			Apply(http.HandlerFunc(orderHandler), tagMiddleware("a"), tagMiddleware("b")),
+			"b,a",
+		},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Body.String(); got != c.want {
+			t.Errorf("Failed %s: expected order %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestChainAppendDoesNotShareBacking(t *testing.T) {
+	base := NewChain(tagMiddleware("a")).Append(tagMiddleware("b"))
+	first := base.Append(tagMiddleware("c"))
+	second := base.Append(tagMiddleware("d"))
+
+	for _, c := range []struct {
+		chain Chain
+		want  string
+	}{{first, "a,b,c"}, {second, "a,b,d"}} {
+		w := httptest.NewRecorder()
+		c.chain.ThenFunc(orderHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Body.String(); got != c.want {
+			t.Errorf("Expected order %q, got %q", c.want, got)
+		}
+	}
+}
+
+func TestWhen(t *testing.T) {
+	chain := NewChain(
+		When(PathPrefix("/api/"), tagMiddleware("api")),
+		Unless(Methods(http.MethodGet, http.MethodHead), tagMiddleware("write")),
+	)
+	handler := chain.ThenFunc(orderHandler)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{"When applies to matching requests", http.MethodGet, "/api/users", "api"},
+		{"When skips other requests", http.MethodGet, "/static/app.js", ""},
+		{"Unless applies to requests that don't match", http.MethodPost, "/api/users", "api,write"},
+		{"Unless skips matching requests", http.MethodHead, "/other", ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if got := w.Body.String(); got != c.want {
+			t.Errorf("Failed %s: expected order %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestChainHandle(t *testing.T) {
+	mux := http.NewServeMux()
+	base := NewChain(tagMiddleware("base"))
+	base.HandleFunc(mux, "/public", orderHandler)
+	base.Append(tagMiddleware("auth")).Handle(mux, "/private", http.HandlerFunc(orderHandler))
+
+	for path, want := range map[string]string{"/public": "base", "/private": "base,auth"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := w.Body.String(); got != want {
+			t.Errorf("Failed %s: expected order %q, got %q", path, want, got)
+		}
+	}
+}
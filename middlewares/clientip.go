@@ -0,0 +1,163 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTrustedProxies are the networks trusted to set forwarding headers
+// when no ClientIP middleware has run: loopback and private addresses, where
+// load balancers and sidecars usually live
+var DefaultTrustedProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+var defaultClientIPResolver = MustClientIPResolver(DefaultTrustedProxies...)
+
+// ClientIPResolver finds the IP address of the client that made a request,
+// looking through forwarding headers set by trusted proxies
+type ClientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// NewClientIPResolver returns a ClientIPResolver that trusts proxies in the
+// given networks. Networks are CIDRs ("10.0.0.0/8", "2001:db8::/32") or
+// single addresses.
+func NewClientIPResolver(trustedProxies ...string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			resolver.trusted = append(resolver.trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		addr = addr.Unmap()
+		resolver.trusted = append(resolver.trusted, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return resolver, nil
+}
+
+// MustClientIPResolver is like NewClientIPResolver but panics if a network
+// can't be parsed
+func MustClientIPResolver(trustedProxies ...string) *ClientIPResolver {
+	resolver, err := NewClientIPResolver(trustedProxies...)
+	if err != nil {
+		panic(err)
+	}
+	return resolver
+}
+
+func (c *ClientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr.WithZone("")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client IP address for r. If the connection comes from
+// a trusted proxy, the Forwarded header, or X-Forwarded-For if there is none,
+// is walked from right to left and the first address that isn't a trusted
+// proxy is returned. X-Real-IP is only used when a trusted proxy sends no
+// forwarding chain. If the remote address can't be parsed, it is returned
+// as is.
+func (c *ClientIPResolver) Resolve(r *http.Request) string {
+	peer, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !c.isTrusted(peer) {
+		return peer.String()
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+	if len(hops) == 0 {
+		if realIP, ok := parseHost(r.Header.Get("X-Real-IP")); ok {
+			return realIP.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHost(hops[i])
+		if !ok {
+			// An obfuscated or garbled hop; the proxy that reported it is the
+			// last address we can vouch for
+			break
+		}
+		client = hop
+		if !c.isTrusted(hop) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded header values
+func forwardedFor(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, node, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, node)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHost parses an IP address that may have a port, brackets or quotes,
+// such as "192.0.2.1", "192.0.2.1:443", "2001:db8::1", or
+// "\"[2001:db8::1]:443\""
+func parseHost(host string) (netip.Addr, bool) {
+	host = strings.Trim(strings.TrimSpace(host), `"`)
+	if host == "" {
+		return netip.Addr{}, false
+	}
+	if addrPort, err := netip.ParseAddrPort(host); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// ClientIP is a middleware that resolves the client IP address with resolver
+// and places it into the request context, where it is used by Logging and
+// RateLimitByIP. Without it, they resolve the address with
+// DefaultTrustedProxies.
+func ClientIP(resolver *ClientIPResolver) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(ContextWithClientIP(r.Context(), resolver.Resolve(r))))
+		})
+	}
+}
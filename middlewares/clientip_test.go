@@ -0,0 +1,136 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver := MustClientIPResolver("10.0.0.0/8", "2001:db8::/32", "192.0.2.1")
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			"Resolve uses the peer without headers",
+			"203.0.113.5:1234",
+			http.Header{},
+			"203.0.113.5",
+		},
+		{
+			"Resolve ignores headers from untrusted peers",
+			"203.0.113.5:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}, "X-Real-Ip": {"198.51.100.1"}},
+			"203.0.113.5",
+		},
+		{
+			"Resolve returns the right-most untrusted X-Forwarded-For hop",
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.1.1.1, 198.51.100.1, 10.0.0.2"}},
+			"198.51.100.1",
+		},
+		{
+			"Resolve joins repeated X-Forwarded-For headers",
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.1.1.1", "198.51.100.1,10.0.0.2"}},
+			"198.51.100.1",
+		},
+		{
+			"Resolve returns the left-most hop when all are trusted",
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			"10.0.0.3",
+		},
+		{
+			"Resolve stops at garbled hops",
+			"10.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"1.1.1.1, garbage, 10.0.0.2"}},
+			"10.0.0.2",
+		},
+		{
+			"Resolve prefers Forwarded over X-Forwarded-For",
+			"10.0.0.1:1234",
+			http.Header{
+				"Forwarded":       {`for=198.51.100.7;proto=https, for="[2001:db8:cafe::17]:4711"`},
+				"X-Forwarded-For": {"1.1.1.1"},
+			},
+			"198.51.100.7",
+		},
+		{
+			"Resolve parses IPv6 Forwarded nodes",
+			"[2001:db8::1]:443",
+			http.Header{"Forwarded": {`for="[2001:db9::17]:4711";by=_proxy`}},
+			"2001:db9::17",
+		},
+		{
+			"Resolve stops at obfuscated Forwarded nodes",
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+			"10.0.0.2",
+		},
+		{
+			"Resolve uses X-Real-IP from trusted peers without a chain",
+			"192.0.2.1:1234",
+			http.Header{"X-Real-Ip": {"198.51.100.9"}},
+			"198.51.100.9",
+		},
+		{
+			"Resolve unmaps IPv4-mapped addresses",
+			"[::ffff:10.0.0.1]:1234",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+			"198.51.100.1",
+		},
+		{
+			"Resolve handles bare IPv6 addresses",
+			"2001:db8::5",
+			http.Header{},
+			"2001:db8::5",
+		},
+		{
+			"Resolve returns unparseable remote addresses as is",
+			"@",
+			http.Header{},
+			"@",
+		},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header = c.header
+		if got := resolver.Resolve(req); got != c.want {
+			t.Errorf("Failed %s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestNewClientIPResolverRejectsInvalidNetworks(t *testing.T) {
+	for _, network := range []string{"10.0.0.0/33", "not an ip", ""} {
+		if _, err := NewClientIPResolver(network); err == nil {
+			t.Errorf("Expected an error for %q", network)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var got string
+	var limitKey string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = ClientIPFromContext(r.Context())
+		limitKey, _ = RateLimitByIP(r)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	ClientIP(MustClientIPResolver("203.0.113.0/24"))(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != "198.51.100.1" {
+		t.Errorf("Expected client IP 198.51.100.1 in context, got %q", got)
+	}
+	if limitKey != "ip:198.51.100.1" {
+		t.Errorf("Expected RateLimitByIP to use the resolved IP, got %q", limitKey)
+	}
+}
@@ -0,0 +1,473 @@
+package middlewares
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/skuid/spec/mapvalue"
+)
+
+// Encoder returns a writer that compresses what is written to it into w.
+// Close is called once the response is complete.
+type Encoder func(w io.Writer) io.WriteCloser
+
+// GzipEncoder returns an Encoder for the gzip content coding at the given
+// compress/gzip level. Writers are pooled between responses.
+func GzipEncoder(level int) Encoder {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, level)
+		return gz
+	}}
+	return func(w io.Writer) io.WriteCloser {
+		gz := pool.Get().(*gzip.Writer)
+		gz.Reset(w)
+		return &pooledEncoder{gz, pool}
+	}
+}
+
+// DeflateEncoder returns an Encoder for the deflate content coding, which
+// HTTP defines as zlib-wrapped DEFLATE, at the given compress/flate level.
+// Writers are pooled between responses.
+func DeflateEncoder(level int) Encoder {
+	if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+		level = zlib.DefaultCompression
+	}
+	pool := &sync.Pool{New: func() interface{} {
+		zw, _ := zlib.NewWriterLevel(io.Discard, level)
+		return zw
+	}}
+	return func(w io.Writer) io.WriteCloser {
+		zw := pool.Get().(*zlib.Writer)
+		zw.Reset(w)
+		return &pooledEncoder{zw, pool}
+	}
+}
+
+type resettableWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type pooledEncoder struct {
+	resettableWriter
+	pool *sync.Pool
+}
+
+func (e *pooledEncoder) Close() error {
+	err := e.resettableWriter.Close()
+	e.resettableWriter.Reset(io.Discard)
+	e.pool.Put(e.resettableWriter)
+	return err
+}
+
+// DefaultCompressContentTypes are the media types compressed when
+// CompressOptions.ContentTypes is empty
+var DefaultCompressContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+// encodingPreference orders content codings when a client accepts several
+// with the same quality. Other encoders are preferred after these, in name
+// order.
+var encodingPreference = []string{"br", "zstd", "gzip", "deflate"}
+
+// CompressOptions configures the Compress middleware
+type CompressOptions struct {
+	// Encoders maps content codings to Encoders. Defaults to gzip and deflate
+	// at the default compression level. Other codings, such as "br" or
+	// "zstd", can be supported by adding an Encoder from a third party
+	// package.
+	Encoders map[string]Encoder
+	// MinSize is the response size in bytes below which responses are sent
+	// uncompressed. Defaults to 1024.
+	MinSize int
+	// ContentTypes are the media types that are compressed, in the same
+	// forms accepted by RequireContentType. Defaults to
+	// DefaultCompressContentTypes.
+	ContentTypes []string
+}
+
+// Compress is a middleware that compresses responses with the best content
+// coding the client lists in Accept-Encoding. Responses are only compressed
+// if they are at least MinSize bytes, have one of ContentTypes, and weren't
+// already encoded by the handler. Compressed responses drop Content-Length,
+// and all responses get "Vary: Accept-Encoding".
+//
+// To have Logging and InstrumentRoute record the compressed size, apply them
+// outside of Compress:
+//
+//	middlewares.Apply(h, middlewares.Compress(middlewares.CompressOptions{}), middlewares.Logging())
+func Compress(opts CompressOptions) Middleware {
+	if len(opts.Encoders) == 0 {
+		opts.Encoders = map[string]Encoder{
+			"gzip":    GzipEncoder(gzip.DefaultCompression),
+			"deflate": DeflateEncoder(zlib.DefaultCompression),
+		}
+	}
+	if opts.MinSize <= 0 {
+		opts.MinSize = 1024
+	}
+	if len(opts.ContentTypes) == 0 {
+		opts.ContentTypes = DefaultCompressContentTypes
+	}
+	contentTypes := make([]string, len(opts.ContentTypes))
+	for i, t := range opts.ContentTypes {
+		contentTypes[i] = strings.ToLower(t)
+	}
+
+	encodings := []string{}
+	for _, name := range encodingPreference {
+		if _, ok := opts.Encoders[name]; ok {
+			encodings = append(encodings, name)
+		}
+	}
+	others := []string{}
+	for name := range opts.Encoders {
+		if !mapvalue.StringSliceContainsKey(encodingPreference, name) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	encodings = append(encodings, others...)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Upgraded connections are hijacked, so there is no body to
+			// compress
+			if r.Header.Get("Upgrade") != "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+			if encoding == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				encoder:        opts.Encoders[encoding],
+				minSize:        opts.MinSize,
+				contentTypes:   contentTypes,
+				status:         http.StatusOK,
+			}
+			h.ServeHTTP(wrapCompressWriter(cw), r)
+			cw.close()
+		})
+	}
+}
+
+// negotiateEncoding returns the encoding in encodings with the highest
+// quality in an Accept-Encoding header, or "" if none are acceptable.
+// Encodings earlier in the list win ties.
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(key), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qualities[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q = qualities["*"]
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether the
+// response should be compressed, then either compresses or passes through
+// the rest
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	encoder      Encoder
+	minSize      int
+	contentTypes []string
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || cw.wroteHeader {
+		return
+	}
+	if code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent ||
+		header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		cw.decide(false)
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < cw.minSize {
+		cw.decide(false)
+		return
+	}
+	if header.Get("Content-Type") != "" && !cw.compressible() {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(data)
+		}
+		return cw.ResponseWriter.Write(data)
+	}
+
+	cw.buf = append(cw.buf, data...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(cw.compressible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// flush sends any buffered data. A response that is flushed before reaching
+// MinSize is compressed if its type allows, since it is being streamed.
+func (cw *compressWriter) flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(cw.compressible())
+	}
+	if flusher, ok := cw.enc.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	cw.ResponseWriter.(http.Flusher).Flush()
+}
+
+// readFrom copies src into the response, handing it to the wrapped writer's
+// ReadFrom once the response is known to be sent uncompressed, so sendfile
+// still applies
+func (cw *compressWriter) readFrom(src io.Reader) (int64, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	var n int64
+	if !cw.decided {
+		// Writing MinSize bytes decides whether to compress
+		copied, err := io.CopyN(cw, src, int64(cw.minSize-len(cw.buf)))
+		n += copied
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	var copied int64
+	var err error
+	if cw.enc != nil {
+		copied, err = io.Copy(cw.enc, src)
+	} else {
+		copied, err = cw.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	}
+	return n + copied, err
+}
+
+func (cw *compressWriter) compressible() bool {
+	contentType := cw.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(cw.buf)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && contentTypeAllowed(cw.contentTypes, mediaType)
+}
+
+// decide sends the response headers and any buffered data, compressing the
+// rest of the response if compress is set
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// Sniff before compressing, as the server would otherwise sniff the
+		// compressed bytes
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		cw.enc = cw.encoder(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends a response that ended below MinSize and finishes compressed
+// responses
+func (cw *compressWriter) close() {
+	if !cw.decided && cw.wroteHeader {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// compressResponseWriter is the http.ResponseWriter passed to handlers by
+// Compress
+type compressResponseWriter interface {
+	http.ResponseWriter
+	Unwrap() http.ResponseWriter
+}
+
+// wrapCompressWriter returns cw implementing the optional interfaces
+// http.Flusher, http.Pusher and io.ReaderFrom that its underlying writer
+// implements, as WrapResponseWriter does. http.Hijacker is never kept:
+// Upgrade requests, which are the ones hijacked, aren't wrapped, and
+// hijacking part way through a compressed response would corrupt it.
+func wrapCompressWriter(cw *compressWriter) compressResponseWriter {
+	_, isFlusher := cw.ResponseWriter.(http.Flusher)
+	_, isPusher := cw.ResponseWriter.(http.Pusher)
+	_, isReaderFrom := cw.ResponseWriter.(io.ReaderFrom)
+
+	f := compressFlusher{cw}
+	p := compressPusher{cw}
+	rf := compressReaderFrom{cw}
+
+	switch {
+	case !isFlusher && !isPusher && !isReaderFrom:
+		return cw
+	case isFlusher && !isPusher && !isReaderFrom:
+		return struct {
+			compressResponseWriter
+			http.Flusher
+		}{cw, f}
+	case !isFlusher && isPusher && !isReaderFrom:
+		return struct {
+			compressResponseWriter
+			http.Pusher
+		}{cw, p}
+	case isFlusher && isPusher && !isReaderFrom:
+		return struct {
+			compressResponseWriter
+			http.Flusher
+			http.Pusher
+		}{cw, f, p}
+	case !isFlusher && !isPusher && isReaderFrom:
+		return struct {
+			compressResponseWriter
+			io.ReaderFrom
+		}{cw, rf}
+	case isFlusher && !isPusher && isReaderFrom:
+		return struct {
+			compressResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{cw, f, rf}
+	case !isFlusher && isPusher && isReaderFrom:
+		return struct {
+			compressResponseWriter
+			http.Pusher
+			io.ReaderFrom
+		}{cw, p, rf}
+	default:
+		return struct {
+			compressResponseWriter
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{cw, f, p, rf}
+	}
+}
+
+type compressFlusher struct {
+	cw *compressWriter
+}
+
+func (f compressFlusher) Flush() {
+	f.cw.flush()
+}
+
+type compressPusher struct {
+	cw *compressWriter
+}
+
+func (p compressPusher) Push(target string, opts *http.PushOptions) error {
+	return p.cw.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+type compressReaderFrom struct {
+	cw *compressWriter
+}
+
+func (rf compressReaderFrom) ReadFrom(src io.Reader) (int64, error) {
+	return rf.cw.readFrom(src)
+}
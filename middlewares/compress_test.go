@@ -0,0 +1,327 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	encodings := []string{"br", "gzip", "deflate"}
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		want           string
+	}{
+		{"negotiateEncoding handles a missing header", "", ""},
+		{"negotiateEncoding picks the only match", "gzip", "gzip"},
+		{"negotiateEncoding prefers earlier encodings on ties", "deflate, gzip", "gzip"},
+		{"negotiateEncoding honors quality", "gzip;q=0.5, deflate", "deflate"},
+		{"negotiateEncoding excludes q=0", "gzip;q=0, deflate;q=0.1", "deflate"},
+		{"negotiateEncoding matches wildcards", "*", "br"},
+		{"negotiateEncoding lets explicit codings override wildcards", "br;q=0, *;q=0.5", "gzip"},
+		{"negotiateEncoding ignores unknown codings", "identity, compress", ""},
+		{"negotiateEncoding ignores case and whitespace", " GZIP ; Q=1 ", "gzip"},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.acceptEncoding, encodings); got != c.want {
+			t.Errorf("Failed %s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := `{"data": "` + strings.Repeat("a", 2048) + `"}`
+
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		contentLength  bool
+		status         int
+		body           string
+		wantEncoding   string
+	}{
+		{"Compress gzips large JSON", "gzip", "application/json", false, http.StatusOK, large, "gzip"},
+		{"Compress uses zlib for deflate", "deflate", "application/json", false, http.StatusOK, large, "deflate"},
+		{"Compress drops Content-Length", "gzip", "application/json", true, http.StatusOK, large, "gzip"},
+		{"Compress sniffs a missing Content-Type", "gzip", "", false, http.StatusOK, strings.Repeat("hello ", 300), "gzip"},
+		{"Compress compresses error responses", "gzip", "application/problem+json", false, http.StatusBadRequest, large, "gzip"},
+		{"Compress skips small responses", "gzip", "application/json", false, http.StatusOK, `{"data": "a"}`, ""},
+		{"Compress skips small responses by Content-Length", "gzip", "application/json", true, http.StatusOK, `{"data": "a"}`, ""},
+		{"Compress skips other content types", "gzip", "image/png", false, http.StatusOK, large, ""},
+		{"Compress skips clients that don't accept an encoding", "", "application/json", false, http.StatusOK, large, ""},
+		{"Compress skips responses without a body", "gzip", "application/json", false, http.StatusNoContent, "", ""},
+	}
+	for _, c := range cases {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.contentType != "" {
+				w.Header().Set("Content-Type", c.contentType)
+			}
+			if c.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(c.body)))
+			}
+			w.WriteHeader(c.status)
+			// Write in pieces to exercise buffering
+			for i := 0; i < len(c.body); i += 100 {
+				end := i + 100
+				if end > len(c.body) {
+					end = len(c.body)
+				}
+				w.Write([]byte(c.body[i:end]))
+			}
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		Compress(CompressOptions{})(handler).ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("Failed %s: expected status %d, got %d", c.name, c.status, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != c.wantEncoding {
+			t.Errorf("Failed %s: expected Content-Encoding %q, got %q", c.name, c.wantEncoding, got)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Failed %s: expected Vary Accept-Encoding, got %q", c.name, got)
+		}
+		if c.wantEncoding != "" && w.Header().Get("Content-Length") != "" {
+			t.Errorf("Failed %s: expected no Content-Length on a compressed response", c.name)
+		}
+
+		var reader io.Reader = w.Body
+		var err error
+		switch c.wantEncoding {
+		case "gzip":
+			reader, err = gzip.NewReader(w.Body)
+		case "deflate":
+			reader, err = zlib.NewReader(w.Body)
+		}
+		if err != nil {
+			t.Errorf("Failed %s: unable to read compressed body: %v", c.name, err)
+			continue
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			t.Errorf("Failed %s: unable to read compressed body: %v", c.name, err)
+		}
+		if string(body) != c.body {
+			t.Errorf("Failed %s: body did not round trip", c.name)
+		}
+	}
+}
+
+func TestCompressLeavesEncodedResponses(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), 2048)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(body)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	w := httptest.NewRecorder()
+	Compress(CompressOptions{})(handler).ServeHTTP(w, req)
+
+	if got := w.Header().Get("Content-Encoding"); got != "br" {
+		t.Errorf("Expected Content-Encoding br, got %q", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("Expected the body to be unchanged")
+	}
+}
+
+type upperEncoder struct {
+	w io.Writer
+}
+
+func (u upperEncoder) Write(data []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(data))
+}
+
+func (u upperEncoder) Close() error {
+	return nil
+}
+
+func TestCompressCustomEncoder(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	})
+	mw := Compress(CompressOptions{
+		Encoders: map[string]Encoder{
+			"gzip":  GzipEncoder(gzip.BestSpeed),
+			"upper": func(w io.Writer) io.WriteCloser { return upperEncoder{w} },
+		},
+		MinSize: 1,
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0.5, upper")
+	w := httptest.NewRecorder()
+	mw(handler).ServeHTTP(w, req)
+
+	if got := w.Header().Get("Content-Encoding"); got != "upper" {
+		t.Errorf("Expected Content-Encoding upper, got %q", got)
+	}
+	if got := w.Body.String(); got != "HELLO" {
+		t.Errorf("Expected body HELLO, got %q", got)
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	flushed := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-flushed
+		w.Write([]byte("data: second\n\n"))
+	})
+	server := httptest.NewServer(Compress(CompressOptions{})(handler))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Error making request to test server: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip, got %q", got)
+	}
+
+	// The first event must be readable before the handler finishes
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read compressed body: %v", err)
+	}
+	first := make([]byte, len("data: first\n\n"))
+	if _, err := io.ReadFull(gz, first); err != nil || string(first) != "data: first\n\n" {
+		t.Errorf("Expected the first event, got %q (%v)", first, err)
+	}
+	close(flushed)
+	rest, _ := io.ReadAll(gz)
+	if string(rest) != "data: second\n\n" {
+		t.Errorf("Expected the second event, got %q", rest)
+	}
+}
+
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestCompressWriterInterfaces(t *testing.T) {
+	cases := []struct {
+		name           string
+		writer         http.ResponseWriter
+		wantFlusher    bool
+		wantReaderFrom bool
+	}{
+		{"Compress exposes no optional interfaces on a plain writer", &plainWriter{http.Header{}}, false, false},
+		{"Compress exposes Flusher", httptest.NewRecorder(), true, false},
+		{"Compress exposes Flusher and ReaderFrom", &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}, true, true},
+	}
+	for _, c := range cases {
+		var w http.ResponseWriter
+		handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			w = rw
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		Compress(CompressOptions{})(handler).ServeHTTP(c.writer, req)
+
+		if _, ok := w.(http.Flusher); ok != c.wantFlusher {
+			t.Errorf("Failed %s: http.Flusher Expected: %v, got: %v", c.name, c.wantFlusher, ok)
+		}
+		if _, ok := w.(http.Hijacker); ok {
+			t.Errorf("Failed %s: expected no http.Hijacker", c.name)
+		}
+		if _, ok := w.(io.ReaderFrom); ok != c.wantReaderFrom {
+			t.Errorf("Failed %s: io.ReaderFrom Expected: %v, got: %v", c.name, c.wantReaderFrom, ok)
+		}
+	}
+}
+
+func TestCompressReadFrom(t *testing.T) {
+	large := strings.Repeat("a", 4096)
+	cases := []struct {
+		name         string
+		contentType  string
+		wantEncoding string
+		wantReadFrom bool
+	}{
+		{"Compress compresses ReadFrom", "application/json", "gzip", false},
+		{"Compress passes uncompressed ReadFrom through", "image/png", "", true},
+	}
+	for _, c := range cases {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			w.(io.ReaderFrom).ReadFrom(strings.NewReader(large))
+		})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+		Compress(CompressOptions{})(handler).ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Encoding"); got != c.wantEncoding {
+			t.Errorf("Failed %s: expected Content-Encoding %q, got %q", c.name, c.wantEncoding, got)
+		}
+		if w.readFrom != c.wantReadFrom {
+			t.Errorf("Failed %s: expected ReadFrom on the underlying writer %v, got %v", c.name, c.wantReadFrom, w.readFrom)
+		}
+		var reader io.Reader = w.Body
+		if c.wantEncoding == "gzip" {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Errorf("Failed %s: unable to read compressed body: %v", c.name, err)
+				continue
+			}
+			reader = gz
+		}
+		if body, _ := io.ReadAll(reader); string(body) != large {
+			t.Errorf("Failed %s: body did not round trip", c.name)
+		}
+	}
+}
+
+func TestCompressLogsCompressedSize(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": "` + strings.Repeat("a", 4096) + `"}`))
+	})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	Apply(handler, Compress(CompressOptions{}), Logging()).ServeHTTP(w, req)
+
+	logs := observed.TakeAll()
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(logs))
+	}
+	if got := logs[0].ContextMap()["body_bytes"]; got != int64(w.Body.Len()) {
+		t.Errorf("Expected body_bytes %d, got %v", w.Body.Len(), got)
+	}
+}
@@ -0,0 +1,327 @@
+package middlewares
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skuid/spec/lifecycle"
+	"go.uber.org/zap"
+)
+
+// ConcurrencyLimit decides how many requests may be handled at once
+type ConcurrencyLimit interface {
+	// Limit returns the current maximum number of in-flight requests
+	Limit() int
+	// Observe records the latency of a completed request, and whether it
+	// failed in a way that indicates overload (a 503 or 504)
+	Observe(latency time.Duration, dropped bool)
+}
+
+// StaticConcurrencyLimit is a ConcurrencyLimit that never changes
+type StaticConcurrencyLimit int
+
+// Limit satisfies the ConcurrencyLimit interface
+func (s StaticConcurrencyLimit) Limit() int {
+	return int(s)
+}
+
+// Observe satisfies the ConcurrencyLimit interface
+func (s StaticConcurrencyLimit) Observe(time.Duration, bool) {}
+
+// AIMDOptions configures an AIMD ConcurrencyLimit
+type AIMDOptions struct {
+	// Initial, Min and Max bound the limit. Min defaults to 1 and Max to
+	// 1000.
+	Initial int
+	Min     int
+	Max     int
+	// LatencyThreshold is the latency above which a request counts as
+	// overload
+	LatencyThreshold time.Duration
+	// Backoff is the factor the limit is multiplied by on overload. Defaults
+	// to 0.9.
+	Backoff float64
+}
+
+type aimdLimit struct {
+	mu    sync.Mutex
+	opts  AIMDOptions
+	limit float64
+}
+
+// NewAIMDLimit returns a ConcurrencyLimit that grows additively, by one
+// request per limit's worth of healthy requests, and shrinks multiplicatively
+// when a request is slower than LatencyThreshold or dropped
+func NewAIMDLimit(opts AIMDOptions) ConcurrencyLimit {
+	if opts.Min <= 0 {
+		opts.Min = 1
+	}
+	if opts.Max <= 0 {
+		opts.Max = 1000
+	}
+	if opts.Initial <= 0 {
+		opts.Initial = opts.Min
+	}
+	if opts.Backoff <= 0 || opts.Backoff >= 1 {
+		opts.Backoff = 0.9
+	}
+	return &aimdLimit{opts: opts, limit: float64(opts.Initial)}
+}
+
+func (a *aimdLimit) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return int(a.limit)
+}
+
+func (a *aimdLimit) Observe(latency time.Duration, dropped bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if dropped || (a.opts.LatencyThreshold > 0 && latency > a.opts.LatencyThreshold) {
+		a.limit = math.Max(float64(a.opts.Min), math.Floor(a.limit*a.opts.Backoff))
+		return
+	}
+	a.limit = math.Min(float64(a.opts.Max), a.limit+1/a.limit)
+}
+
+// GradientOptions configures a gradient ConcurrencyLimit
+type GradientOptions struct {
+	// Initial, Min and Max bound the limit. Min defaults to 1 and Max to
+	// 1000.
+	Initial int
+	Min     int
+	Max     int
+	// Smoothing is how much of each new estimate is applied to the limit,
+	// between 0 and 1. Defaults to 0.2.
+	Smoothing float64
+	// ProbeInterval is the number of samples after which the minimum latency
+	// is forgotten and measured again. Defaults to 1000.
+	ProbeInterval int
+}
+
+type gradientLimit struct {
+	mu      sync.Mutex
+	opts    GradientOptions
+	limit   float64
+	minRTT  float64
+	rtt     float64
+	samples int
+}
+
+// NewGradientLimit returns a ConcurrencyLimit that adjusts the limit by the
+// ratio between the lowest observed latency and the current average latency,
+// so the limit shrinks as queueing makes requests slower
+func NewGradientLimit(opts GradientOptions) ConcurrencyLimit {
+	if opts.Min <= 0 {
+		opts.Min = 1
+	}
+	if opts.Max <= 0 {
+		opts.Max = 1000
+	}
+	if opts.Initial <= 0 {
+		opts.Initial = opts.Min
+	}
+	if opts.Smoothing <= 0 || opts.Smoothing > 1 {
+		opts.Smoothing = 0.2
+	}
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = 1000
+	}
+	return &gradientLimit{opts: opts, limit: float64(opts.Initial)}
+}
+
+func (g *gradientLimit) Limit() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int(g.limit)
+}
+
+func (g *gradientLimit) Observe(latency time.Duration, dropped bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sample := float64(latency)
+	if sample <= 0 {
+		return
+	}
+	g.samples++
+	if g.samples > g.opts.ProbeInterval {
+		g.samples = 0
+		g.minRTT = 0
+	}
+	if g.minRTT == 0 || sample < g.minRTT {
+		g.minRTT = sample
+	}
+	if g.rtt == 0 {
+		g.rtt = sample
+	} else {
+		g.rtt = 0.9*g.rtt + 0.1*sample
+	}
+
+	gradient := math.Max(0.5, math.Min(1, g.minRTT/g.rtt))
+	if dropped {
+		gradient = 0.5
+	}
+	estimate := g.limit*gradient + math.Sqrt(g.limit)
+	g.limit = g.limit*(1-g.opts.Smoothing) + estimate*g.opts.Smoothing
+	g.limit = math.Max(float64(g.opts.Min), math.Min(float64(g.opts.Max), g.limit))
+}
+
+// ConcurrencyOptions configures the LimitConcurrency middleware
+type ConcurrencyOptions struct {
+	// Limit decides how many requests may be in flight
+	Limit ConcurrencyLimit
+	// MaxWait is how long a request may wait for a free slot. Zero rejects
+	// requests as soon as the limit is reached.
+	MaxWait time.Duration
+	// MaxQueue is the number of requests that may wait at once. Zero allows
+	// as many requests to wait as the current limit.
+	MaxQueue int
+	// StatusCode is returned for rejected requests. Defaults to 503.
+	StatusCode int
+	// OverloadReadiness, if set, marks the application not ready with
+	// lifecycle.MarkNotReady once requests have been rejected continuously
+	// for this long, so load balancers route traffic elsewhere. Readiness is
+	// restored when in-flight requests fall below half the limit.
+	OverloadReadiness time.Duration
+}
+
+type concurrencyLimiter struct {
+	opts           ConcurrencyOptions
+	mu             sync.Mutex
+	inFlight       int
+	waiters        *list.List
+	saturatedSince time.Time
+	releaseReady   func()
+}
+
+// acquire waits for a slot, returning false if the request should be rejected
+func (c *concurrencyLimiter) acquire(r *http.Request) bool {
+	c.mu.Lock()
+	if c.inFlight < c.opts.Limit.Limit() && c.waiters.Len() == 0 {
+		c.inFlight++
+		c.saturatedSince = time.Time{}
+		c.mu.Unlock()
+		return true
+	}
+	maxQueue := c.opts.MaxQueue
+	if maxQueue <= 0 {
+		maxQueue = c.opts.Limit.Limit()
+	}
+	if c.opts.MaxWait <= 0 || c.waiters.Len() >= maxQueue {
+		c.saturated()
+		c.mu.Unlock()
+		return false
+	}
+	ready := make(chan struct{})
+	element := c.waiters.PushBack(ready)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(c.opts.MaxWait)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-ready:
+		// The slot was handed over as the wait ended
+		return true
+	default:
+	}
+	c.waiters.Remove(element)
+	c.saturated()
+	return false
+}
+
+// saturated records a rejection, flipping readiness if configured. c.mu must
+// be held.
+func (c *concurrencyLimiter) saturated() {
+	now := time.Now()
+	if c.saturatedSince.IsZero() {
+		c.saturatedSince = now
+	}
+	if c.opts.OverloadReadiness > 0 && c.releaseReady == nil && now.Sub(c.saturatedSince) >= c.opts.OverloadReadiness {
+		c.releaseReady = lifecycle.MarkNotReady()
+		zap.L().Warn("Overloaded, marking application not ready", zap.Int("in_flight", c.inFlight))
+	}
+}
+
+// release frees a slot, handing it to the next waiting request if the limit
+// allows
+func (c *concurrencyLimiter) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	limit := c.opts.Limit.Limit()
+	for c.inFlight < limit && c.waiters.Len() > 0 {
+		ready := c.waiters.Remove(c.waiters.Front()).(chan struct{})
+		c.inFlight++
+		close(ready)
+	}
+	if c.releaseReady != nil && c.inFlight < limit/2+1 {
+		c.releaseReady()
+		c.releaseReady = nil
+		c.saturatedSince = time.Time{}
+		zap.L().Info("Recovered from overload, releasing readiness", zap.Int("in_flight", c.inFlight))
+	}
+}
+
+// LimitConcurrency is a middleware that caps the number of requests handled
+// at once. When the limit is reached, requests wait up to MaxWait for a free
+// slot and are otherwise rejected with StatusCode. The following metrics are
+// added:
+//
+//	# Counter
+//	http_request_shed{"sha", "method", "path"}
+//	# Gauge
+//	http_concurrency_limit
+//	# Gauge
+//	http_concurrency_in_flight
+func LimitConcurrency(opts ConcurrencyOptions) Middleware {
+	if opts.StatusCode == 0 {
+		opts.StatusCode = http.StatusServiceUnavailable
+	}
+	c := &concurrencyLimiter{opts: opts, waiters: list.New()}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			statsdClient := Client()
+			if !c.acquire(r) {
+				if statsdClient != nil {
+					statsdClient.Incr("http_request_shed", requestTags(r.Method, r.URL.Path), 1)
+				}
+				AddLogFields(r.Context(), zap.Bool("shed", true))
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.Header().Set("Retry-After", strconv.Itoa(1))
+				w.WriteHeader(opts.StatusCode)
+				w.Write([]byte(`{"error": "server is overloaded"}`))
+				return
+			}
+
+			wrappedWriter := WrapResponseWriter(w)
+			start := time.Now()
+			defer func() {
+				status := wrappedWriter.Status()
+				opts.Limit.Observe(time.Since(start), status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout)
+				c.release()
+				if statsdClient != nil {
+					c.mu.Lock()
+					inFlight := c.inFlight
+					c.mu.Unlock()
+					statsdClient.Gauge("http_concurrency_limit", float64(opts.Limit.Limit()), nil, 1)
+					statsdClient.Gauge("http_concurrency_in_flight", float64(inFlight), nil, 1)
+				}
+			}()
+			h.ServeHTTP(wrappedWriter, r)
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skuid/spec/lifecycle"
+)
+
+// serveBlocked starts a request that holds its slot until release is closed,
+// and returns once the handler is running
+func serveBlocked(handler http.Handler, started chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-started
+}
+
+func TestLimitConcurrency(t *testing.T) {
+	cases := []struct {
+		name       string
+		opts       ConcurrencyOptions
+		wantStatus int
+		wantReady  bool
+	}{
+		{
+			"LimitConcurrency rejects requests over the limit",
+			ConcurrencyOptions{Limit: StaticConcurrencyLimit(1)},
+			http.StatusServiceUnavailable,
+			true,
+		},
+		{
+			"LimitConcurrency uses the configured status",
+			ConcurrencyOptions{Limit: StaticConcurrencyLimit(1), StatusCode: http.StatusTooManyRequests},
+			http.StatusTooManyRequests,
+			true,
+		},
+		{
+			"LimitConcurrency rejects after waiting",
+			ConcurrencyOptions{Limit: StaticConcurrencyLimit(1), MaxWait: 10 * time.Millisecond},
+			http.StatusServiceUnavailable,
+			true,
+		},
+		{
+			"LimitConcurrency flips readiness when overloaded",
+			ConcurrencyOptions{Limit: StaticConcurrencyLimit(1), OverloadReadiness: time.Millisecond},
+			http.StatusServiceUnavailable,
+			false,
+		},
+	}
+	for _, c := range cases {
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		handler := LimitConcurrency(c.opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		}))
+
+		var wg sync.WaitGroup
+		serveBlocked(handler, started, &wg)
+
+		// Overload starts at the first rejection, so reject twice
+		for i := 0; i < 2; i++ {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			if recorder.Code != c.wantStatus {
+				t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+			}
+			time.Sleep(2 * time.Millisecond)
+		}
+		if ready := lifecycle.IsReady(); ready != c.wantReady {
+			t.Errorf("Failed %s: lifecycle.IsReady Expected: %v, got: %v", c.name, c.wantReady, ready)
+		}
+		close(release)
+		wg.Wait()
+		if !lifecycle.IsReady() {
+			t.Errorf("Failed %s: Expected readiness to be restored", c.name)
+		}
+	}
+}
+
+func TestLimitConcurrencyQueues(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := LimitConcurrency(ConcurrencyOptions{Limit: StaticConcurrencyLimit(1), MaxWait: time.Second})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		}),
+	)
+
+	var wg sync.WaitGroup
+	serveBlocked(handler, started, &wg)
+
+	done := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- recorder.Code
+	}()
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected the queued request to be handled, got status %d", code)
+	}
+	wg.Wait()
+}
+
+func TestAdaptiveConcurrencyLimits(t *testing.T) {
+	aimd := NewAIMDLimit(AIMDOptions{Initial: 10, Max: 11, LatencyThreshold: 100 * time.Millisecond})
+	for i := 0; i < 50; i++ {
+		aimd.Observe(10*time.Millisecond, false)
+	}
+	if aimd.Limit() != 11 {
+		t.Errorf("Expected AIMD to grow to its max, got %d", aimd.Limit())
+	}
+	aimd.Observe(time.Second, false)
+	if aimd.Limit() != 9 {
+		t.Errorf("Expected AIMD to back off on slow requests, got %d", aimd.Limit())
+	}
+
+	gradient := NewGradientLimit(GradientOptions{Initial: 100})
+	for i := 0; i < 20; i++ {
+		gradient.Observe(10*time.Millisecond, false)
+	}
+	healthy := gradient.Limit()
+	for i := 0; i < 50; i++ {
+		gradient.Observe(100*time.Millisecond, false)
+	}
+	if gradient.Limit() >= healthy {
+		t.Errorf("Expected gradient limit to shrink as latency grows, got %d then %d", healthy, gradient.Limit())
+	}
+}
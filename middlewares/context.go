@@ -8,61 +8,88 @@ package middlewares
 import (
 	"context"
 	"errors"
+
+	"github.com/skuid/spec/mapvalue"
 )
 
 type contextKey string
 
 var userContextKey = contextKey("user")
+var requestIDContextKey = contextKey("requestID")
+var cspNonceContextKey = contextKey("cspNonce")
+var clientIPContextKey = contextKey("clientIP")
+
+// Identity describes the user a request is made on behalf of
+type Identity struct {
+	UserID    string
+	OrgID     string
+	Subdomain string
+	Admin     bool
+	Roles     []string
+	Scopes    []string
+	// Claims holds any other attributes of the user, such as the claims of
+	// the token they authenticated with
+	Claims map[string]interface{}
+}
+
+// HasRole reports whether the identity has the given role
+func (i Identity) HasRole(role string) bool {
+	return mapvalue.StringSliceContainsKey(i.Roles, role)
+}
+
+// HasScope reports whether the identity has the given scope
+func (i Identity) HasScope(scope string) bool {
+	return mapvalue.StringSliceContainsKey(i.Scopes, scope)
+}
+
+// IdentityFromContext retrieves an Identity stored in a context
+func IdentityFromContext(ctx context.Context) (Identity, error) {
+	identity, ok := ctx.Value(userContextKey).(Identity)
+	if !ok {
+		return Identity{}, errors.New("User is not stored in given context")
+	}
+	return identity, nil
+}
+
+// ContextWithIdentity places an Identity into a context using the context user key
+func ContextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, userContextKey, identity)
+}
 
 // OrgIDFromContext retrieves an organization ID value stored in a context
 func OrgIDFromContext(ctx context.Context) (string, error) {
-	u := ctx.Value(userContextKey)
-	if u == nil {
-		return "", errors.New("User is not stored in given context")
+	identity, err := IdentityFromContext(ctx)
+	if err != nil {
+		return "", err
 	}
-	orgID, ok := u.(map[string]interface{})["orgID"]
-	if !ok {
+	if identity.OrgID == "" {
 		return "", errors.New("OrgID is not stored in given context")
 	}
-	orgIDString, ok := orgID.(string)
-	if !ok || orgIDString == "" {
-		return "", errors.New("OrgID not stored as string in given context")
-	}
-	return orgIDString, nil
+	return identity.OrgID, nil
 }
 
 // SubdomainFromContext retrieves an organization's subdomain value stored in a context
 func SubdomainFromContext(ctx context.Context) (string, error) {
-	u := ctx.Value(userContextKey)
-	if u == nil {
-		return "", errors.New("User is not stored in given context")
+	identity, err := IdentityFromContext(ctx)
+	if err != nil {
+		return "", err
 	}
-	subdomain, ok := u.(map[string]interface{})["subdomain"]
-	if !ok {
+	if identity.Subdomain == "" {
 		return "", errors.New("subdomain is not stored in given context")
 	}
-	subdomainString, ok := subdomain.(string)
-	if !ok || subdomainString == "" {
-		return "", errors.New("subdomain not stored as string in given context")
-	}
-	return subdomainString, nil
+	return identity.Subdomain, nil
 }
 
 // UserIDFromContext retrieves an organization ID value stored in a context
 func UserIDFromContext(ctx context.Context) (string, error) {
-	u := ctx.Value(userContextKey)
-	if u == nil {
-		return "", errors.New("User is not stored in given context")
+	identity, err := IdentityFromContext(ctx)
+	if err != nil {
+		return "", err
 	}
-	v, ok := u.(map[string]interface{})["userID"]
-	if !ok {
+	if identity.UserID == "" {
 		return "", errors.New("UserID is not stored in given context")
 	}
-	vString, ok := v.(string)
-	if !ok || vString == "" {
-		return "", errors.New("userID not stored as string in given context")
-	}
-	return vString, nil
+	return identity.UserID, nil
 }
 
 // ContextWithUser places a user ID value, org Id value, and admin bool into a context using the same context user key
@@ -72,24 +99,61 @@ func ContextWithUser(ctx context.Context, userID string, orgID string, admin boo
 
 // ContextWithSiteAndUserInfo places a user ID value, site Id, site subdomain, and admin bool into a context using the same context user key
 func ContextWithSiteAndUserInfo(ctx context.Context, userID string, orgID string, subdomain string, admin bool) context.Context {
-	userValues := map[string]interface{}{
-		"orgID":     orgID,
-		"subdomain": subdomain,
-		"userID":    userID,
-		"admin":     admin,
-	}
-	return context.WithValue(ctx, userContextKey, userValues)
+	return ContextWithIdentity(ctx, Identity{
+		UserID:    userID,
+		OrgID:     orgID,
+		Subdomain: subdomain,
+		Admin:     admin,
+	})
 }
 
 // IsAdminFromContext returns a boolean indicating whether the user is an admin or not
 func IsAdminFromContext(ctx context.Context) bool {
-	u := ctx.Value(userContextKey)
-	if u == nil {
+	identity, err := IdentityFromContext(ctx)
+	if err != nil {
 		return false
 	}
+	return identity.Admin
+}
 
-	if v, ok := u.(map[string]interface{})["admin"]; !ok || v == false {
-		return false
+// RequestIDHeader is the header used to send and return request IDs
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDFromContext retrieves a request ID value stored in a context
+func RequestIDFromContext(ctx context.Context) (string, error) {
+	requestID, ok := ctx.Value(requestIDContextKey).(string)
+	if !ok || requestID == "" {
+		return "", errors.New("Request ID is not stored in given context")
+	}
+	return requestID, nil
+}
+
+// ContextWithRequestID places a request ID value into a context
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, requestID)
+}
+
+// ClientIPFromContext retrieves the client IP address resolved for the
+// request by the ClientIP middleware
+func ClientIPFromContext(ctx context.Context) (string, error) {
+	ip, ok := ctx.Value(clientIPContextKey).(string)
+	if !ok || ip == "" {
+		return "", errors.New("Client IP is not stored in given context")
+	}
+	return ip, nil
+}
+
+// ContextWithClientIP places a client IP address into a context
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey, ip)
+}
+
+// CSPNonceFromContext retrieves the Content-Security-Policy nonce generated
+// for the request by the SecurityHeaders middleware
+func CSPNonceFromContext(ctx context.Context) (string, error) {
+	nonce, ok := ctx.Value(cspNonceContextKey).(string)
+	if !ok || nonce == "" {
+		return "", errors.New("CSP nonce is not stored in given context")
 	}
-	return true
+	return nonce, nil
 }
@@ -0,0 +1,66 @@
+package middlewares
+
+import (
+	"context"
+	"testing"
+)
+
+func TestIdentityContext(t *testing.T) {
+	identity := Identity{
+		UserID:    "user1",
+		OrgID:     "org1",
+		Subdomain: "acme",
+		Admin:     true,
+		Roles:     []string{"editor"},
+		Scopes:    []string{"read", "write"},
+	}
+	ctx := ContextWithIdentity(context.Background(), identity)
+
+	got, err := IdentityFromContext(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !got.HasRole("editor") || got.HasRole("admin") {
+		t.Errorf("HasRole returned unexpected results for roles %v", got.Roles)
+	}
+	if !got.HasScope("write") || got.HasScope("delete") {
+		t.Errorf("HasScope returned unexpected results for scopes %v", got.Scopes)
+	}
+	if userID, _ := UserIDFromContext(ctx); userID != "user1" {
+		t.Errorf("UserIDFromContext Expected: user1, got: %q", userID)
+	}
+	if orgID, _ := OrgIDFromContext(ctx); orgID != "org1" {
+		t.Errorf("OrgIDFromContext Expected: org1, got: %q", orgID)
+	}
+	if subdomain, _ := SubdomainFromContext(ctx); subdomain != "acme" {
+		t.Errorf("SubdomainFromContext Expected: acme, got: %q", subdomain)
+	}
+	if !IsAdminFromContext(ctx) {
+		t.Errorf("IsAdminFromContext Expected: true, got: false")
+	}
+}
+
+func TestIdentityContextMissing(t *testing.T) {
+	cases := []struct {
+		name string
+		ctx  context.Context
+	}{
+		{"Getters handle an empty context", context.Background()},
+		{"Getters handle empty values", ContextWithUser(context.Background(), "", "", false)},
+		{"Getters handle a foreign value under the user key", context.WithValue(context.Background(), userContextKey, map[string]interface{}{"orgID": 1})},
+	}
+	for _, c := range cases {
+		if _, err := UserIDFromContext(c.ctx); err == nil {
+			t.Errorf("Failed %s: UserIDFromContext Expected an error", c.name)
+		}
+		if _, err := OrgIDFromContext(c.ctx); err == nil {
+			t.Errorf("Failed %s: OrgIDFromContext Expected an error", c.name)
+		}
+		if _, err := SubdomainFromContext(c.ctx); err == nil {
+			t.Errorf("Failed %s: SubdomainFromContext Expected an error", c.name)
+		}
+		if IsAdminFromContext(c.ctx) {
+			t.Errorf("Failed %s: IsAdminFromContext Expected: false", c.name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package middlewares
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures the CORS middleware
+type CORSOptions struct {
+	// AllowedOrigins is a list of origins a cross-domain request can be
+	// executed from. An entry may be an exact origin
+	// ("https://example.com"), a wildcard subdomain origin
+	// ("https://*.example.com") or "*" to allow every origin.
+	AllowedOrigins []string
+	// AllowedOriginPatterns is a list of regular expressions matched against
+	// the full origin, in addition to AllowedOrigins. Patterns are anchored
+	// at both ends, so `https://app\.example\.com` doesn't allow
+	// https://app.example.com.evil.net.
+	AllowedOriginPatterns []*regexp.Regexp
+	// AllowedMethods is a list of methods the client is allowed to use.
+	// Defaults to GET, HEAD and POST.
+	AllowedMethods []string
+	// AllowedHeaders is a list of non-simple headers the client is allowed to
+	// send. "*" allows any header.
+	AllowedHeaders []string
+	// ExposedHeaders is a list of response headers the client is allowed to
+	// read.
+	ExposedHeaders []string
+	// AllowCredentials indicates whether the request can include user
+	// credentials like cookies and HTTP authentication. It can't be combined
+	// with the "*" origin, which would let any site make authenticated
+	// requests on behalf of a user; list the trusted origins instead.
+	AllowCredentials bool
+	// MaxAge is how long the results of a preflight request can be cached.
+	// Zero omits the Access-Control-Max-Age header.
+	MaxAge time.Duration
+}
+
+type cors struct {
+	allowAllOrigins  bool
+	origins          map[string]bool
+	wildcardOrigins  [][2]string
+	originPatterns   []*regexp.Regexp
+	methods          map[string]bool
+	allowedMethods   string
+	allowAllHeaders  bool
+	headers          map[string]bool
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+}
+
+func newCORS(opts CORSOptions) *cors {
+	c := &cors{
+		origins:          map[string]bool{},
+		methods:          map[string]bool{},
+		headers:          map[string]bool{},
+		exposedHeaders:   strings.Join(canonicalHeaders(opts.ExposedHeaders), ", "),
+		allowCredentials: opts.AllowCredentials,
+	}
+
+	for _, pattern := range opts.AllowedOriginPatterns {
+		c.originPatterns = append(c.originPatterns, regexp.MustCompile(`^(?:`+pattern.String()+`)$`))
+	}
+	for _, origin := range opts.AllowedOrigins {
+		origin = strings.ToLower(origin)
+		switch {
+		case origin == "*":
+			if opts.AllowCredentials {
+				panic(`middlewares: CORS can't allow credentials from every origin ("*")`)
+			}
+			c.allowAllOrigins = true
+		case strings.Contains(origin, "*"):
+			parts := strings.SplitN(origin, "*", 2)
+			c.wildcardOrigins = append(c.wildcardOrigins, [2]string{parts[0], parts[1]})
+		default:
+			c.origins[origin] = true
+		}
+	}
+
+	allowedMethods := opts.AllowedMethods
+	if len(allowedMethods) == 0 {
+		allowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	methods := make([]string, 0, len(allowedMethods))
+	for _, method := range allowedMethods {
+		method = strings.ToUpper(method)
+		methods = append(methods, method)
+		c.methods[method] = true
+	}
+	c.allowedMethods = strings.Join(methods, ", ")
+
+	for _, header := range canonicalHeaders(opts.AllowedHeaders) {
+		if header == "*" {
+			c.allowAllHeaders = true
+		}
+		c.headers[header] = true
+	}
+
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.Itoa(int(opts.MaxAge / time.Second))
+	}
+	return c
+}
+
+func canonicalHeaders(headers []string) []string {
+	canonical := make([]string, 0, len(headers))
+	for _, header := range headers {
+		header = strings.TrimSpace(header)
+		if header != "" {
+			canonical = append(canonical, http.CanonicalHeaderKey(header))
+		}
+	}
+	return canonical
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	if c.allowAllOrigins {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, w := range c.wildcardOrigins {
+		if len(origin) > len(w[0])+len(w[1]) && strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			return true
+		}
+	}
+	for _, pattern := range c.originPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) headersAllowed(requested string) bool {
+	if c.allowAllHeaders {
+		return true
+	}
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header != "" && !c.headers[http.CanonicalHeaderKey(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin sets the Access-Control-Allow-Origin and
+// Access-Control-Allow-Credentials headers for an allowed origin
+func (c *cors) allowOrigin(h http.Header, origin string) {
+	if c.allowAllOrigins {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *cors) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	origin := r.Header.Get("Origin")
+	method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+
+	if c.originAllowed(origin) && c.methods[method] && c.headersAllowed(requestedHeaders) {
+		c.allowOrigin(h, origin)
+		h.Set("Access-Control-Allow-Methods", c.allowedMethods)
+		if requestedHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", requestedHeaders)
+		}
+		if c.maxAge != "" {
+			h.Set("Access-Control-Max-Age", c.maxAge)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *cors) handleRequest(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	origin := r.Header.Get("Origin")
+	if !c.originAllowed(origin) {
+		return
+	}
+	c.allowOrigin(h, origin)
+	if c.exposedHeaders != "" {
+		h.Set("Access-Control-Expose-Headers", c.exposedHeaders)
+	}
+}
+
+// CORS is a middleware implementing Cross-Origin Resource Sharing. Preflight
+// requests (OPTIONS with an Access-Control-Request-Method header) are answered
+// directly with a 204 and are not passed to the wrapped handler. Other
+// requests from an allowed origin have the appropriate Access-Control-*
+// headers added before being handled. Requests from origins that are not
+// allowed are handled without any CORS headers, so browsers will block them.
+// Every response varies on Origin. CORS panics if opts allows credentials
+// from the "*" origin.
+func CORS(opts CORSOptions) Middleware {
+	c := newCORS(opts)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+			if r.Header.Get("Origin") == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				c.handlePreflight(w, r)
+				return
+			}
+			c.handleRequest(w, r)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
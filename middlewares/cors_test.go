@@ -0,0 +1,190 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	opts := CORSOptions{
+		AllowedOrigins:        []string{"https://example.com", "https://*.skuid.com"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+		AllowedMethods:        []string{"get", "put"},
+		AllowedHeaders:        []string{"content-type", "x-request-id"},
+		ExposedHeaders:        []string{"x-request-id"},
+		AllowCredentials:      true,
+		MaxAge:                10 * time.Minute,
+	}
+
+	cases := []struct {
+		name        string
+		method      string
+		header      map[string]string
+		wantStatus  int
+		wantHeaders map[string]string
+		wantHandled bool
+	}{
+		{
+			"CORS passes through requests without an Origin",
+			http.MethodGet,
+			map[string]string{},
+			http.StatusOK,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+			true,
+		},
+		{
+			"CORS allows an exact origin",
+			http.MethodGet,
+			map[string]string{"Origin": "https://example.com"},
+			http.StatusOK,
+			map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-Id",
+				"Vary":                             "Origin",
+			},
+			true,
+		},
+		{
+			"CORS allows a wildcard subdomain origin",
+			http.MethodGet,
+			map[string]string{"Origin": "https://acme.skuid.com"},
+			http.StatusOK,
+			map[string]string{"Access-Control-Allow-Origin": "https://acme.skuid.com"},
+			true,
+		},
+		{
+			"CORS does not match the bare wildcard domain",
+			http.MethodGet,
+			map[string]string{"Origin": "https://.skuid.com"},
+			http.StatusOK,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+			true,
+		},
+		{
+			"CORS allows a regex origin",
+			http.MethodGet,
+			map[string]string{"Origin": "http://localhost:3000"},
+			http.StatusOK,
+			map[string]string{"Access-Control-Allow-Origin": "http://localhost:3000"},
+			true,
+		},
+		{
+			"CORS omits headers for a disallowed origin",
+			http.MethodGet,
+			map[string]string{"Origin": "https://evil.com"},
+			http.StatusOK,
+			map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+			true,
+		},
+		{
+			"CORS answers an allowed preflight",
+			http.MethodOptions,
+			map[string]string{
+				"Origin":                         "https://example.com",
+				"Access-Control-Request-Method":  "PUT",
+				"Access-Control-Request-Headers": "Content-Type",
+			},
+			http.StatusNoContent,
+			map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Methods":     "GET, PUT",
+				"Access-Control-Allow-Headers":     "Content-Type",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Max-Age":           "600",
+			},
+			false,
+		},
+		{
+			"CORS rejects a preflight with a disallowed method",
+			http.MethodOptions,
+			map[string]string{
+				"Origin":                        "https://example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			http.StatusNoContent,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+			false,
+		},
+		{
+			"CORS rejects a preflight with a disallowed header",
+			http.MethodOptions,
+			map[string]string{
+				"Origin":                         "https://example.com",
+				"Access-Control-Request-Method":  "GET",
+				"Access-Control-Request-Headers": "Authorization",
+			},
+			http.StatusNoContent,
+			map[string]string{"Access-Control-Allow-Origin": ""},
+			false,
+		},
+	}
+	for _, c := range cases {
+		handled := false
+		handler := CORS(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled = true
+		}))
+		request := httptest.NewRequest(c.method, "/", nil)
+		for header, value := range c.header {
+			request.Header.Set(header, value)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		if handled != c.wantHandled {
+			t.Errorf("Failed %s: handled Expected: %v, got: %v", c.name, c.wantHandled, handled)
+		}
+		for header, want := range c.wantHeaders {
+			if got := recorder.Header().Get(header); got != want {
+				t.Errorf("Failed %s: %s Expected: %q, got: %q", c.name, header, want, got)
+			}
+		}
+	}
+}
+
+func TestCORSAllowAll(t *testing.T) {
+	handler := CORS(CORSOptions{AllowedOrigins: []string{"*"}})(http.NotFoundHandler())
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set("Origin", "https://anywhere.com")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected Access-Control-Allow-Origin *, got: %q", got)
+	}
+}
+
+func TestCORSRejectsCredentialsFromAnyOrigin(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected CORS to panic when allowing credentials from every origin")
+		}
+	}()
+	CORS(CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
+
+func TestCORSAnchorsOriginPatterns(t *testing.T) {
+	handler := CORS(CORSOptions{
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`https://app\.example\.com`)},
+		AllowCredentials:      true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for origin, allowed := range map[string]bool{
+		"https://app.example.com":                  true,
+		"https://app.example.com.evil.net":         false,
+		"https://evil.net/https://app.example.com": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", origin)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if got := recorder.Header().Get("Access-Control-Allow-Origin") != ""; got != allowed {
+			t.Errorf("Failed %s: allowed Expected: %v, got: %v", origin, allowed, got)
+		}
+	}
+}
@@ -4,16 +4,29 @@ import (
 	"net/http"
 	"strings"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 )
 
+// IsGrpcRequest reports whether r is a gRPC request
+func IsGrpcRequest(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(
+		r.Header.Get("Content-Type"), "application/grpc") && !IsGrpcWebRequest(r)
+}
+
+// IsGrpcWebRequest reports whether r is a gRPC-Web request from a browser
+// client, in either the binary or the base64 text format
+func IsGrpcWebRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web")
+}
+
 // HandleGrpc passes gRPC requests to the given *grpc.Server and passes http
 // requests on to the http handler
 func HandleGrpc(server *grpc.Server) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.ProtoMajor == 2 && strings.HasPrefix(
-				r.Header.Get("Content-Type"), "application/grpc") {
+			if IsGrpcRequest(r) {
 				server.ServeHTTP(w, r)
 			} else {
 				h.ServeHTTP(w, r)
@@ -22,3 +35,40 @@ func HandleGrpc(server *grpc.Server) Middleware {
 
 	}
 }
+
+// HandleGrpcWeb passes gRPC-Web requests, and their CORS preflight requests,
+// to grpcWeb and passes other requests on to the http handler. grpcWeb is
+// typically a wrapped *grpc.Server from a gRPC-Web proxy library.
+func HandleGrpcWeb(grpcWeb http.Handler) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			preflight := r.Method == http.MethodOptions &&
+				strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+			if IsGrpcWebRequest(r) || preflight {
+				grpcWeb.ServeHTTP(w, r)
+			} else {
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+// H2C is a middleware that lets the wrapped handler serve HTTP/2 over
+// cleartext connections, both with prior knowledge and by upgrading HTTP/1.1
+// requests. net/http only negotiates HTTP/2 over TLS, so without it
+// HandleGrpc never sees gRPC traffic on a plaintext listener. It should be the
+// outermost middleware.
+func H2C() Middleware {
+	return func(h http.Handler) http.Handler {
+		return h2c.NewHandler(h, &http2.Server{})
+	}
+}
+
+// NewGrpcHandler returns an http.Handler serving gRPC requests with server and
+// all other requests with h, over both TLS and plaintext connections
+//
+//	handler := middlewares.NewGrpcHandler(grpcServer, mux)
+//	httpServer := &http.Server{Addr: ":3000", Handler: handler}
+func NewGrpcHandler(server *grpc.Server, h http.Handler) http.Handler {
+	return Apply(h, HandleGrpc(server), H2C())
+}
@@ -0,0 +1,313 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skuid/spec/version"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys used to propagate the request ID and Identity between gRPC
+// services
+const (
+	MetadataRequestID = "x-request-id"
+	MetadataUserID    = "x-user-id"
+	MetadataOrgID     = "x-org-id"
+	MetadataSubdomain = "x-subdomain"
+	MetadataAdmin     = "x-admin"
+	MetadataRoles     = "x-roles"
+	MetadataScopes    = "x-scopes"
+)
+
+// splitMethod splits a full gRPC method name ("/package.Service/Method") into
+// its service and method
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+func grpcTags(fullMethod string) []string {
+	service, method := splitMethod(fullMethod)
+	return []string{
+		fmt.Sprintf("%s:%s", "sha", version.Commit),
+		fmt.Sprintf("%s:%s", "service", service),
+		fmt.Sprintf("%s:%s", "method", method),
+	}
+}
+
+func grpcMonitor(prefix, fullMethod string, err error, start time.Time) {
+	statsdClient := Client()
+	if statsdClient == nil {
+		return
+	}
+	elapsed := float64((time.Since(start)) / time.Microsecond)
+	tags := append(grpcTags(fullMethod), fmt.Sprintf("%s:%s", "code", status.Code(err)))
+	statsdClient.Incr(prefix+"_request_count", tags, 1)
+	statsdClient.Histogram(prefix+"_request_duration", elapsed, tags, 1)
+}
+
+func grpcLog(ctx context.Context, msg string, fullMethod string, err error, start time.Time) {
+	code := status.Code(err)
+	fields := []zapcore.Field{
+		zap.String("method", fullMethod),
+		zap.String("code", code.String()),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+	fields = append(fields, contextFields(ctx)...)
+	zap.L().Info(msg, fields...)
+}
+
+func grpcRecover(ctx context.Context, fullMethod string, rec interface{}) error {
+	fields := []zapcore.Field{
+		zap.String("panic", fmt.Sprint(rec)),
+		zap.String("method", fullMethod),
+		zap.Stack("stacktrace"),
+	}
+	fields = append(fields, contextFields(ctx)...)
+	zap.L().Error("Recovered from panic", fields...)
+
+	if statsdClient := Client(); statsdClient != nil {
+		statsdClient.Incr("grpc_request_panic", grpcTags(fullMethod), 1)
+	}
+	return status.Error(codes.Internal, "internal server error")
+}
+
+// ContextWithMetadataUser places the request ID and Identity found in
+// incoming gRPC metadata into ctx. Metadata is set by callers, so this should
+// only be used for traffic from trusted services.
+func ContextWithMetadataUser(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	get := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	split := func(key string) []string {
+		if value := get(key); value != "" {
+			return strings.Split(value, ",")
+		}
+		return nil
+	}
+
+	if requestID := get(MetadataRequestID); requestID != "" {
+		ctx = ContextWithRequestID(ctx, requestID)
+	}
+	if userID := get(MetadataUserID); userID != "" {
+		admin, _ := strconv.ParseBool(get(MetadataAdmin))
+		ctx = ContextWithIdentity(ctx, Identity{
+			UserID:    userID,
+			OrgID:     get(MetadataOrgID),
+			Subdomain: get(MetadataSubdomain),
+			Admin:     admin,
+			Roles:     split(MetadataRoles),
+			Scopes:    split(MetadataScopes),
+		})
+	}
+	return ctx
+}
+
+// OutgoingContextWithUser adds the request ID and Identity stored in ctx to
+// its outgoing gRPC metadata
+func OutgoingContextWithUser(ctx context.Context) context.Context {
+	pairs := []string{}
+	if requestID, err := RequestIDFromContext(ctx); err == nil {
+		pairs = append(pairs, MetadataRequestID, requestID)
+	}
+	if identity, err := IdentityFromContext(ctx); err == nil && identity.UserID != "" {
+		pairs = append(pairs,
+			MetadataUserID, identity.UserID,
+			MetadataOrgID, identity.OrgID,
+			MetadataSubdomain, identity.Subdomain,
+			MetadataAdmin, strconv.FormatBool(identity.Admin),
+			MetadataRoles, strings.Join(identity.Roles, ","),
+			MetadataScopes, strings.Join(identity.Scopes, ","),
+		)
+	}
+	if len(pairs) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// UnaryServerLogging is the gRPC equivalent of Logging. Each call is logged
+// with its method, status code, duration, and the request ID and user fields
+// from the context.
+func UnaryServerLogging() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		grpcLog(ctx, "gRPC request", info.FullMethod, err, start)
+		return resp, err
+	}
+}
+
+// StreamServerLogging is the streaming equivalent of UnaryServerLogging
+func StreamServerLogging() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		grpcLog(ss.Context(), "gRPC request", info.FullMethod, err, start)
+		return err
+	}
+}
+
+// UnaryServerInstrument is the gRPC equivalent of InstrumentRoute.
+// The following metrics are added:
+//
+//	# Counter
+//	grpc_request_count{"sha", "service", "method", "code"}
+//	# Histogram
+//	grpc_request_duration{"sha", "service", "method", "code"}
+func UnaryServerInstrument() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		grpcMonitor("grpc", info.FullMethod, err, start)
+		return resp, err
+	}
+}
+
+// StreamServerInstrument is the streaming equivalent of UnaryServerInstrument
+func StreamServerInstrument() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		grpcMonitor("grpc", info.FullMethod, err, start)
+		return err
+	}
+}
+
+// UnaryServerRecover is the gRPC equivalent of Recover. A panicking handler
+// is logged with a stacktrace, the following metric is added, and the call
+// fails with codes.Internal.
+//
+//	# Counter
+//	grpc_request_panic{"sha", "service", "method"}
+func UnaryServerRecover() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = grpcRecover(ctx, info.FullMethod, rec)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerRecover is the streaming equivalent of UnaryServerRecover
+func StreamServerRecover() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = grpcRecover(ss.Context(), info.FullMethod, rec)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// UnaryServerUserContext places the request ID and Identity from incoming
+// metadata into the call context. See ContextWithMetadataUser.
+func UnaryServerUserContext() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ContextWithMetadataUser(ctx), req)
+	}
+}
+
+// StreamServerUserContext is the streaming equivalent of UnaryServerUserContext
+func StreamServerUserContext() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, contextServerStream{ss, ContextWithMetadataUser(ss.Context())})
+	}
+}
+
+// UnaryClientLogging logs each outgoing call with its method, status code,
+// duration, and the request ID and user fields from the context
+func UnaryClientLogging() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		grpcLog(ctx, "gRPC client request", method, err, start)
+		return err
+	}
+}
+
+// StreamClientLogging logs the establishment of each outgoing stream
+func StreamClientLogging() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		grpcLog(ctx, "gRPC client stream", method, err, start)
+		return stream, err
+	}
+}
+
+// UnaryClientInstrument adds metrics for outgoing calls.
+// The following metrics are added:
+//
+//	# Counter
+//	grpc_client_request_count{"sha", "service", "method", "code"}
+//	# Histogram
+//	grpc_client_request_duration{"sha", "service", "method", "code"}
+func UnaryClientInstrument() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		grpcMonitor("grpc_client", method, err, start)
+		return err
+	}
+}
+
+// StreamClientInstrument adds metrics for the establishment of outgoing
+// streams, using the same metric names as UnaryClientInstrument
+func StreamClientInstrument() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		start := time.Now()
+		stream, err := streamer(ctx, desc, cc, method, opts...)
+		grpcMonitor("grpc_client", method, err, start)
+		return stream, err
+	}
+}
+
+// UnaryClientUserContext forwards the request ID and Identity stored in the
+// call context as outgoing metadata. See OutgoingContextWithUser.
+func UnaryClientUserContext() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(OutgoingContextWithUser(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientUserContext is the streaming equivalent of UnaryClientUserContext
+func StreamClientUserContext() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(OutgoingContextWithUser(ctx), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,119 @@
+package middlewares
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestUnaryServerRecover(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/spec.Test/Panic"}
+	_, err := UnaryServerRecover()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("oh no")
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected code %s, got: %s", codes.Internal, status.Code(err))
+	}
+	if observed.Len() != 1 {
+		t.Errorf("Expected 1 log, got %d", observed.Len())
+	}
+}
+
+func TestSplitMethod(t *testing.T) {
+	cases := []struct {
+		fullMethod  string
+		wantService string
+		wantMethod  string
+	}{
+		{"/grpc.health.v1.Health/Check", "grpc.health.v1.Health", "Check"},
+		{"Check", "unknown", "Check"},
+	}
+	for _, c := range cases {
+		service, method := splitMethod(c.fullMethod)
+		if service != c.wantService || method != c.wantMethod {
+			t.Errorf("Failed splitMethod(%q): Expected: %q %q, got: %q %q", c.fullMethod, c.wantService, c.wantMethod, service, method)
+		}
+	}
+}
+
+func TestGrpcUserPropagation(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	var gotIdentity Identity
+	var gotRequestID string
+	capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		gotIdentity, _ = IdentityFromContext(ctx)
+		gotRequestID, _ = RequestIDFromContext(ctx)
+		return handler(ctx, req)
+	}
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		UnaryServerUserContext(),
+		UnaryServerLogging(),
+		UnaryServerInstrument(),
+		UnaryServerRecover(),
+		capture,
+	))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithChainUnaryInterceptor(UnaryClientUserContext(), UnaryClientLogging(), UnaryClientInstrument()),
+	)
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	ctx := ContextWithIdentity(context.Background(), Identity{
+		UserID:    "user1",
+		OrgID:     "org1",
+		Subdomain: "acme",
+		Admin:     true,
+		Roles:     []string{"editor", "viewer"},
+	})
+	ctx = ContextWithRequestID(ctx, "abc-123")
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if gotIdentity.UserID != "user1" || gotIdentity.OrgID != "org1" || gotIdentity.Subdomain != "acme" || !gotIdentity.Admin {
+		t.Errorf("Identity was not propagated, got: %+v", gotIdentity)
+	}
+	if !gotIdentity.HasRole("viewer") {
+		t.Errorf("Roles were not propagated, got: %v", gotIdentity.Roles)
+	}
+	if gotRequestID != "abc-123" {
+		t.Errorf("Request ID was not propagated, got: %q", gotRequestID)
+	}
+
+	server.Stop()
+	logs := observed.All()
+	if len(logs) != 2 {
+		t.Fatalf("Expected a server and a client log, got %d logs", len(logs))
+	}
+	fields := logs[0].ContextMap()
+	if fields["method"] != "/grpc.health.v1.Health/Check" || fields["code"] != "OK" || fields["siteId"] != "org1" {
+		t.Errorf("Unexpected server log fields: %v", fields)
+	}
+}
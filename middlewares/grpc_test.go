@@ -0,0 +1,79 @@
+package middlewares
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestNewGrpcHandler(t *testing.T) {
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	defer grpcServer.Stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	server := httptest.NewServer(Apply(NewGrpcHandler(grpcServer, mux), InstrumentRoute()))
+	defer server.Close()
+
+	conn, err := grpc.Dial(strings.TrimPrefix(server.URL, "http://"), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("Unable to dial: %v", err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected gRPC error over h2c: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING, got: %s", resp.Status)
+	}
+
+	httpResp, err := http.Get(server.URL + "/hello")
+	if err != nil {
+		t.Fatalf("Unexpected HTTP error: %v", err)
+	}
+	defer httpResp.Body.Close()
+	body, _ := io.ReadAll(httpResp.Body)
+	if string(body) != "hello" {
+		t.Errorf("Expected HTTP/1.1 requests to reach the mux, got: %q", body)
+	}
+}
+
+func TestHandleGrpcWeb(t *testing.T) {
+	cases := []struct {
+		name        string
+		method      string
+		header      map[string]string
+		wantGrpcWeb bool
+	}{
+		{"HandleGrpcWeb routes binary gRPC-Web", http.MethodPost, map[string]string{"Content-Type": "application/grpc-web+proto"}, true},
+		{"HandleGrpcWeb routes text gRPC-Web", http.MethodPost, map[string]string{"Content-Type": "application/grpc-web-text"}, true},
+		{"HandleGrpcWeb routes preflights", http.MethodOptions, map[string]string{"Access-Control-Request-Headers": "content-type,x-grpc-web"}, true},
+		{"HandleGrpcWeb passes through JSON", http.MethodPost, map[string]string{"Content-Type": "application/json"}, false},
+	}
+	for _, c := range cases {
+		gotGrpcWeb := false
+		grpcWeb := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotGrpcWeb = true })
+		handler := HandleGrpcWeb(grpcWeb)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		request := httptest.NewRequest(c.method, "/", nil)
+		for header, value := range c.header {
+			request.Header.Set(header, value)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+		if gotGrpcWeb != c.wantGrpcWeb {
+			t.Errorf("Failed %s: Expected gRPC-Web: %v, got: %v", c.name, c.wantGrpcWeb, gotGrpcWeb)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package middlewares
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skuid/spec/mapvalue"
+	"go.uber.org/zap"
+)
+
+// Supported JWT signing algorithms
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Claims is the decoded payload of a JWT
+type Claims map[string]interface{}
+
+// KeySet provides the keys used to verify JWT signatures. Key returns a
+// []byte for HS256, an *rsa.PublicKey for RS256 or an *ecdsa.PublicKey for
+// ES256.
+type KeySet interface {
+	Key(kid string, alg string) (interface{}, error)
+}
+
+// StaticKeySet is a KeySet backed by a fixed map of key IDs to keys. The key
+// stored under "" is used for tokens without a kid header.
+type StaticKeySet map[string]interface{}
+
+// Key satisfies the KeySet interface
+func (s StaticKeySet) Key(kid string, alg string) (interface{}, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key ID %q", kid)
+	}
+	return key, nil
+}
+
+// JWKSKeySet is a KeySet that loads a JSON Web Key Set from a file or an
+// http(s) URL. Keys are cached for the configured TTL, and an unknown key ID
+// triggers a refresh so rotated keys are picked up. Refreshes are attempted at
+// most once a minute, one at a time and outside the lock, and the cached keys
+// keep being served while the source is unavailable.
+type JWKSKeySet struct {
+	source      string
+	ttl         time.Duration
+	client      *http.Client
+	now         func() time.Time
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	err         error
+	fetched     time.Time
+	lastAttempt time.Time
+	refreshing  chan struct{}
+}
+
+// jwksRetryInterval is the minimum time between attempts to load a JWKS
+const jwksRetryInterval = time.Minute
+
+// NewJWKSKeySet returns a JWKSKeySet reading from source, which is either a
+// file path or an http(s) URL. A ttl of zero or less defaults to an hour.
+func NewJWKSKeySet(source string, ttl time.Duration) *JWKSKeySet {
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	return &JWKSKeySet{
+		source: source,
+		ttl:    ttl,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+// Key satisfies the KeySet interface
+func (j *JWKSKeySet) Key(kid string, alg string) (interface{}, error) {
+	keys, err := j.load(false)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if keys, err = j.load(true); err != nil {
+		return nil, err
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown key ID %q", kid)
+}
+
+// load returns the cached keys, refreshing them first if they have expired or
+// force is set and no attempt was made in the last jwksRetryInterval. Callers
+// only wait for a refresh in progress when there are no cached keys.
+func (j *JWKSKeySet) load(force bool) (map[string]interface{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	stale := force || j.keys == nil || now.Sub(j.fetched) > j.ttl
+	if stale && j.refreshing == nil && now.Sub(j.lastAttempt) >= jwksRetryInterval {
+		done := make(chan struct{})
+		j.refreshing = done
+		j.lastAttempt = now
+		j.mu.Unlock()
+		keys, err := j.fetch()
+		j.mu.Lock()
+
+		if err == nil {
+			j.keys = keys
+			j.fetched = now
+		} else if j.keys != nil {
+			zap.L().Warn("Failed to refresh JWKS, using cached keys", zap.String("source", j.source), zap.Error(err))
+		}
+		j.err = err
+		j.refreshing = nil
+		close(done)
+	} else if j.refreshing != nil && j.keys == nil {
+		wait := j.refreshing
+		j.mu.Unlock()
+		<-wait
+		j.mu.Lock()
+	}
+
+	if j.keys == nil {
+		return nil, j.err
+	}
+	return j.keys, nil
+}
+
+func (j *JWKSKeySet) fetch() (map[string]interface{}, error) {
+	data, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func (j *JWKSKeySet) read() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(j.source)
+	}
+	resp, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d fetching JWKS", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWK %q: %v", jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(jwk.K)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// jwtOptions holds the token validation settings of AuthOptions
+type jwtOptions struct {
+	keys       KeySet
+	algorithms []string
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+func verifyJWT(token string, opts jwtOptions) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Token is malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("Token header is malformed: %v", err)
+	}
+	if !mapvalue.StringSliceContainsKey(opts.algorithms, header.Alg) {
+		return nil, fmt.Errorf("Token algorithm %q is not allowed", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("Token signature is malformed: %v", err)
+	}
+	key, err := opts.keys.Key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Token claims are malformed: %v", err)
+	}
+	if err := validateClaims(claims, opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifySignature(alg string, key interface{}, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return errors.New("Key is not an HS256 secret")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("Token signature is invalid")
+		}
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("Key is not an RS256 public key")
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("Token signature is invalid")
+		}
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("Key is not an ES256 public key")
+		}
+		if len(signature) != 64 {
+			return errors.New("Token signature is invalid")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return errors.New("Token signature is invalid")
+		}
+	default:
+		return fmt.Errorf("Token algorithm %q is not supported", alg)
+	}
+	return nil
+}
+
+func validateClaims(claims Claims, opts jwtOptions) error {
+	now := opts.now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("Token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(opts.leeway)) {
+		return errors.New("Token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(opts.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("Token is not valid yet")
+	}
+	if opts.issuer != "" && mapvalue.String(claims, "iss") != opts.issuer {
+		return errors.New("Token issuer is invalid")
+	}
+	if opts.audience != "" {
+		audiences := mapvalue.StringSlice(claims, "aud")
+		if aud := mapvalue.String(claims, "aud"); aud != "" {
+			audiences = []string{aud}
+		}
+		if !mapvalue.StringSliceContainsKey(audiences, opts.audience) {
+			return errors.New("Token audience is invalid")
+		}
+	}
+	return nil
+}
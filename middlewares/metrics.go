@@ -17,12 +17,7 @@ func monitor(verb, path string, httpCode int, reqStart time.Time) {
 
 	// datadog statsd
 	if statsdClient != nil {
-		tags := [4]string{
-			fmt.Sprintf("%s:%s", "sha", version.Commit),
-			fmt.Sprintf("%s:%s", "method", strings.ToLower(verb)),
-			fmt.Sprintf("%s:%s", "path", path),
-			fmt.Sprintf("%s:%d", "status", httpCode),
-		}
+		tags := append(requestTags(verb, path), fmt.Sprintf("%s:%d", "status", httpCode))
 		statsdClient.Incr("http_request_count", tags[:], 1)
 		statsdClient.Histogram("http_request_duration", elapsed, tags[:3], 1)
 
@@ -30,6 +25,15 @@ func monitor(verb, path string, httpCode int, reqStart time.Time) {
 	}
 }
 
+// requestTags returns the sha, method and path tags common to all request metrics
+func requestTags(verb, path string) []string {
+	return []string{
+		fmt.Sprintf("%s:%s", "sha", version.Commit),
+		fmt.Sprintf("%s:%s", "method", strings.ToLower(verb)),
+		fmt.Sprintf("%s:%s", "path", path),
+	}
+}
+
 func statusType(code int) string {
 	switch math.Floor(float64(code) / float64(100)) {
 	case 5:
@@ -59,10 +63,10 @@ func InstrumentRoute() Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			now := time.Now()
-			wrappedWriter := &statusLoggingResponseWriter{w, http.StatusOK, 0}
+			wrappedWriter := WrapResponseWriter(w)
 
 			defer func() {
-				monitor(r.Method, r.URL.Path, wrappedWriter.status, now)
+				monitor(r.Method, r.URL.Path, wrappedWriter.Status(), now)
 			}()
 			h.ServeHTTP(wrappedWriter, r)
 		})
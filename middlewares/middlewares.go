@@ -10,9 +10,12 @@ Helpful links to read up on go middlewares:
 package middlewares
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -31,7 +34,14 @@ func DdogAppName(t string) string {
 // Middleware is a type for decorating requests.
 type Middleware func(http.Handler) http.Handler
 
-// Apply wraps a list of middlewares around a handler and returns it
+// Apply wraps a list of middlewares around a handler and returns it. Each
+// middleware wraps the result of the ones before it, so the first middleware
+// is innermost and the last is outermost, seeing the request first:
+//
+//	// Logging runs first, then InstrumentRoute, then Recover, then h
+//	Apply(h, Recover(), InstrumentRoute(), Logging())
+//
+// Chain lists middlewares in the opposite, outermost first, order.
 func Apply(h http.Handler, middlewares ...Middleware) http.Handler {
 	for _, adapter := range middlewares {
 		h = adapter(h)
@@ -40,6 +50,9 @@ func Apply(h http.Handler, middlewares ...Middleware) http.Handler {
 }
 
 // AccessControlAllowOrigin is a middleware for adding an access control header to requests
+//
+// Deprecated: AccessControlAllowOrigin sets a single static header and does
+// not handle preflight requests. Use CORS instead.
 func AccessControlAllowOrigin(origin string) Middleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -61,89 +74,291 @@ func AddHeaders(headers map[string]string) Middleware {
 	}
 }
 
-type statusLoggingResponseWriter struct {
-	http.ResponseWriter
-	status    int
-	bodyBytes int
+// getRemoteAddr returns the client IP stored by the ClientIP middleware, or
+// resolves it with DefaultTrustedProxies
+func getRemoteAddr(r *http.Request) string {
+	if ip, err := ClientIPFromContext(r.Context()); err == nil {
+		return ip
+	}
+	return defaultClientIPResolver.Resolve(r)
 }
 
-func (w *statusLoggingResponseWriter) WriteHeader(code int) {
-	w.status = code
-	w.ResponseWriter.WriteHeader(code)
+// contextFields returns log fields for the request ID and user values stored
+// in ctx, omitting any that are not present
+func contextFields(ctx context.Context) []zapcore.Field {
+	fields := []zapcore.Field{}
+	if userID, err := UserIDFromContext(ctx); err == nil {
+		fields = append(fields, zap.String("userId", userID))
+	}
+	if orgID, err := OrgIDFromContext(ctx); err == nil {
+		fields = append(fields, zap.String("siteId", orgID))
+	}
+	if subdomain, err := SubdomainFromContext(ctx); err == nil {
+		fields = append(fields, zap.String("subdomain", subdomain))
+	}
+	if requestID, err := RequestIDFromContext(ctx); err == nil {
+		fields = append(fields, zap.String("requestId", requestID))
+	}
+	return fields
 }
-func (w *statusLoggingResponseWriter) Write(data []byte) (int, error) {
-	length, err := w.ResponseWriter.Write(data)
-	w.bodyBytes += length
-	return length, err
+
+var logFieldsContextKey = contextKey("logFields")
+
+type logFieldCollector struct {
+	mu     sync.Mutex
+	fields []zapcore.Field
+	route  string
 }
 
-func stripPort(remoteAddr string) string {
-	splitIndex := strings.LastIndex(remoteAddr, ":")
-	if splitIndex > 0 {
-		strippedAddress := remoteAddr[0:splitIndex]
-		return strippedAddress
+// AddLogFields adds fields to the request log written by Logging for the
+// request ctx belongs to. It lets inner middlewares and handlers annotate the
+// request log, and has no effect on requests not wrapped by Logging.
+func AddLogFields(ctx context.Context, fields ...zapcore.Field) {
+	collector, ok := ctx.Value(logFieldsContextKey).(*logFieldCollector)
+	if !ok {
+		return
 	}
-	return remoteAddr
+	collector.mu.Lock()
+	collector.fields = append(collector.fields, fields...)
+	collector.mu.Unlock()
 }
 
-func getRemoteAddr(r *http.Request) string {
-	address := r.Header.Get("X-Real-IP")
-	if len(address) > 0 {
-		return stripPort(address)
+// SetRoute records the route template, such as "/users/{id}", that matched
+// the request ctx belongs to, for the route field written by Logging. It has
+// no effect on requests not wrapped by Logging.
+func SetRoute(ctx context.Context, template string) {
+	collector, ok := ctx.Value(logFieldsContextKey).(*logFieldCollector)
+	if !ok {
+		return
 	}
-	address = r.Header.Get("X-Forwarded-For")
-	if len(address) > 0 {
-		return stripPort(address)
+	collector.mu.Lock()
+	collector.route = template
+	collector.mu.Unlock()
+}
+
+// Route is a middleware that records template as the route of each request
+// with SetRoute
+func Route(template string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			SetRoute(r.Context(), template)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// countingReader counts the bytes read from a request body, copying them to
+// tee if it is set
+type countingReader struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	n   int64
+	tee io.Writer
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	c.n += int64(n)
+	c.mu.Unlock()
+	if c.tee != nil {
+		c.tee.Write(p[:n])
 	}
-	return stripPort(r.RemoteAddr)
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
 }
 
-// Logging is a mux middleware for adding a request log. Logs contains the following
-// fields: level, timestamp, response_time, message, path, method, status, query,
-// remote_addr, user_agent, and body_bytes.
+// LoggingOptions configures the LoggingWithOptions middleware
+type LoggingOptions struct {
+	// Closures are evaluated after the request is handled and their fields
+	// are appended to the logged message
+	Closures []func(*http.Request) []zapcore.Field
+	// ParseForm parses the request form before the request is handled, so
+	// the query field includes form values from the body. This consumes the
+	// body of form posts, so it is off by default and the query field only
+	// contains the URL query.
+	ParseForm bool
+	// Sampling drops a share of successful requests from the log. Requests
+	// logged at Warn level or above, including those over SlowThreshold, are
+	// always logged.
+	Sampling LogSampling
+	// DurationUnit is the unit of the duration field. Defaults to
+	// time.Millisecond.
+	DurationUnit time.Duration
+	// OmitFields are the keys of fields to leave out of the log
+	OmitFields []string
+	// SlowThreshold, if set, logs requests that take longer at Warn level
+	// with a slow field
+	SlowThreshold time.Duration
+	// Level picks the log level from the response status. Defaults to
+	// StatusLogLevel.
+	Level func(status int) zapcore.Level
+	// SkipPaths are request paths that aren't logged, such as health checks
+	SkipPaths []string
+	// Message is the log message. Defaults to "HTTP request".
+	Message string
+	// BodyCapture, if set, adds request and response bodies to the log for
+	// some requests
+	BodyCapture *BodyCaptureOptions
+}
+
+// StatusLogLevel logs 5xx responses at Error level, 4xx responses at Warn
+// level, and others at Info level
+func StatusLogLevel(status int) zapcore.Level {
+	switch {
+	case status >= 500:
+		return zapcore.ErrorLevel
+	case status >= 400:
+		return zapcore.WarnLevel
+	default:
+		return zapcore.InfoLevel
+	}
+}
+
+// Logging is a mux middleware for adding a request log. Requests are logged at
+// the level StatusLogLevel picks for their status. Logs contains the following
+// fields: level, timestamp, message, path, method, status, query, remote_addr,
+// user_agent, body_bytes, duration (in milliseconds), start, protocol, host,
+// referer, request_bytes, and route, when set with Route or SetRoute.
 //
 // Logging accepts an optional list of closures that accept the incoming request
 // and return a slice of zapcore.Field. Each closure is evaluated and its response
-// fields are appended to the logged message after the request is handled
+// fields are appended to the logged message after the request is handled.
+// Fields added with AddLogFields while the request is handled are appended
+// last.
 func Logging(closures ...func(*http.Request) []zapcore.Field) Middleware {
+	return LoggingWithOptions(LoggingOptions{Closures: closures})
+}
+
+// LoggingWithOptions is the configurable form of Logging
+func LoggingWithOptions(opts LoggingOptions) Middleware {
+	if opts.DurationUnit <= 0 {
+		opts.DurationUnit = time.Millisecond
+	}
+	if opts.Level == nil {
+		opts.Level = StatusLogLevel
+	}
+	if opts.Message == "" {
+		opts.Message = "HTTP request"
+	}
+	opts.BodyCapture = opts.BodyCapture.withDefaults()
+	omit := map[string]bool{}
+	for _, key := range opts.OmitFields {
+		omit[key] = true
+	}
+	skip := map[string]bool{}
+	for _, path := range opts.SkipPaths {
+		skip[path] = true
+	}
+
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			wrappedWriter := &statusLoggingResponseWriter{w, http.StatusOK, 0}
+			if skip[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			var requestCapture, responseCapture *bodyCapture
+			if opts.BodyCapture.enabled(r) {
+				requestCapture = &bodyCapture{max: opts.BodyCapture.MaxBytes}
+				responseCapture = &bodyCapture{max: opts.BodyCapture.MaxBytes}
+			}
+			wrappedWriter := wrapResponseWriter(w, responseCapture.writer())
+			collector := &logFieldCollector{}
+
+			var body *countingReader
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReader{ReadCloser: r.Body, tee: requestCapture.writer()}
+				r.Body = body
+			}
 
 			defer func() {
+				duration := time.Since(start)
+				level := opts.Level(wrappedWriter.Status())
+				slow := opts.SlowThreshold > 0 && duration > opts.SlowThreshold
+				if slow && level < zapcore.WarnLevel {
+					level = zapcore.WarnLevel
+				}
+				// Slow requests and errors are always logged
+				if level < zapcore.WarnLevel && !opts.Sampling.keep(wrappedWriter.Status(), duration) {
+					return
+				}
+				var requestBytes int64
+				if body != nil {
+					requestBytes = body.count()
+				}
+				query := r.URL.Query().Encode()
+				if opts.ParseForm {
+					query = r.Form.Encode()
+				}
 				fields := []zapcore.Field{
 					zap.String("path", r.URL.Path),
 					zap.String("method", r.Method),
-					zap.Int("status", wrappedWriter.status),
-					zap.String("query", r.Form.Encode()),
+					zap.Int("status", wrappedWriter.Status()),
+					zap.String("query", query),
 					zap.String("remote_addr", getRemoteAddr(r)),
 					zap.String("user_agent", r.Header.Get("User-Agent")),
-					zap.Int("body_bytes", wrappedWriter.bodyBytes),
+					zap.Int("body_bytes", wrappedWriter.BytesWritten()),
+					zap.Float64("duration", float64(duration)/float64(opts.DurationUnit)),
+					zap.Time("start", start),
+					zap.String("protocol", r.Proto),
+					zap.String("host", r.Host),
+					zap.String("referer", r.Referer()),
+					zap.Int64("request_bytes", requestBytes),
+				}
+
+				collector.mu.Lock()
+				if collector.route != "" {
+					fields = append(fields, zap.String("route", collector.route))
+				}
+				collector.mu.Unlock()
+
+				fields = append(fields, contextFields(r.Context())...)
+				for _, f := range opts.Closures {
+					fields = append(fields, f(r)...)
 				}
+				collector.mu.Lock()
+				fields = append(fields, collector.fields...)
+				collector.mu.Unlock()
 
-				if userID, err := UserIDFromContext(r.Context()); err == nil {
-					fields = append(fields, zap.String("userId", userID))
+				if requestCapture != nil {
+					fields = append(fields, opts.BodyCapture.fields("request_body", r.Header, requestCapture)...)
+					fields = append(fields, opts.BodyCapture.fields("response_body", wrappedWriter.Header(), responseCapture)...)
 				}
-				if orgID, err := OrgIDFromContext(r.Context()); err == nil {
-					fields = append(fields, zap.String("siteId", orgID))
+
+				if slow {
+					fields = append(fields, zap.Bool("slow", true))
 				}
-				if subdomain, err := SubdomainFromContext(r.Context()); err == nil {
-					fields = append(fields, zap.String("subdomain", subdomain))
+
+				if len(omit) > 0 {
+					kept := fields[:0]
+					for _, field := range fields {
+						if !omit[field.Key] {
+							kept = append(kept, field)
+						}
+					}
+					fields = kept
 				}
-				for _, f := range closures {
-					fields = append(fields, f(r)...)
+				if ce := zap.L().Check(level, opts.Message); ce != nil {
+					ce.Write(fields...)
 				}
-				zap.L().Info("", fields...)
 			}()
 
-			err := r.ParseForm()
-			if err != nil {
-				zap.L().Error("Error parsing form", zap.Error(err))
-				http.Error(w, `{"error": "error parsing form"}`, http.StatusBadRequest)
-				return
+			if opts.ParseForm {
+				err := r.ParseForm()
+				if err != nil {
+					zap.L().Error("Error parsing form", zap.Error(err))
+					http.Error(wrappedWriter, `{"error": "error parsing form"}`, http.StatusBadRequest)
+					return
+				}
 			}
 
-			h.ServeHTTP(wrappedWriter, r)
+			h.ServeHTTP(wrappedWriter, r.WithContext(context.WithValue(r.Context(), logFieldsContextKey, collector)))
 		})
 	}
 }
@@ -2,9 +2,13 @@ package middlewares
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -61,7 +65,22 @@ func TestGetRemoteAddr(t *testing.T) {
 			"getRemoteAddr handles ipv6",
 			map[string]string{},
 			"[::]:1234",
-			"[::]",
+			"::",
+		},
+		{
+			"getRemoteAddr handles bare ipv6",
+			map[string]string{},
+			"2001:db8::1",
+			"2001:db8::1",
+		},
+		{
+			"getRemoteAddr ignores headers from untrusted peers",
+			map[string]string{
+				"X-Real-IP":       "1.2.3.4",
+				"X-Forwarded-For": "1.2.3.4",
+			},
+			"11.22.33.44:1234",
+			"11.22.33.44",
 		},
 	}
 	for _, c := range cases {
@@ -115,7 +134,190 @@ func TestLoggingClosures(t *testing.T) {
 		t.Fatal("Expected log! Got no logs")
 	}
 	loggedMessage := observed.All()[0]
-	if loggedMessage.Context[7].String != "alfanzo" {
+	if loggedMessage.ContextMap()["user"] != "alfanzo" {
 		t.Errorf("Didn't find alfanzo")
 	}
 }
+
+func TestLoggingParseForm(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	cases := []struct {
+		name      string
+		opts      LoggingOptions
+		wantQuery string
+		wantBody  string
+	}{
+		{
+			"Logging leaves the body for the handler by default",
+			LoggingOptions{},
+			"a=1",
+			"b=2",
+		},
+		{
+			"Logging includes form values when ParseForm is set",
+			LoggingOptions{ParseForm: true},
+			"a=1&b=2",
+			"",
+		},
+	}
+	for _, c := range cases {
+		var gotBody string
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			gotBody = string(body)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/?a=1", strings.NewReader("b=2"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		LoggingWithOptions(c.opts)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		if gotBody != c.wantBody {
+			t.Errorf("Failed %s: expected handler body %q, got %q", c.name, c.wantBody, gotBody)
+		}
+		logs := observed.TakeAll()
+		if len(logs) != 1 {
+			t.Fatalf("Failed %s: expected 1 log, got %d", c.name, len(logs))
+		}
+		if got := logs[0].ContextMap()["query"]; got != c.wantQuery {
+			t.Errorf("Failed %s: expected query %q, got %q", c.name, c.wantQuery, got)
+		}
+	}
+}
+
+func TestLoggingFields(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		if r.URL.Query().Get("sleep") != "" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+
+	cases := []struct {
+		name      string
+		opts      LoggingOptions
+		target    string
+		wantLevel zapcore.Level
+		want      map[string]interface{}
+		omitted   []string
+	}{
+		{
+			"Logging adds request fields",
+			LoggingOptions{},
+			"/users/1",
+			zapcore.InfoLevel,
+			map[string]interface{}{
+				"protocol":      "HTTP/1.1",
+				"host":          "example.com",
+				"referer":       "https://example.com/from",
+				"request_bytes": int64(5),
+				"route":         "/users/",
+			},
+			nil,
+		},
+		{
+			"Logging omits fields",
+			LoggingOptions{OmitFields: []string{"user_agent", "referer"}},
+			"/users/1",
+			zapcore.InfoLevel,
+			map[string]interface{}{"path": "/users/1"},
+			[]string{"user_agent", "referer"},
+		},
+		{
+			"Logging escalates slow requests",
+			LoggingOptions{SlowThreshold: 10 * time.Millisecond},
+			"/users/1?sleep=1",
+			zapcore.WarnLevel,
+			map[string]interface{}{"slow": true},
+			nil,
+		},
+	}
+	for _, c := range cases {
+		mux := http.NewServeMux()
+		NewChain(LoggingWithOptions(c.opts)).Handle(mux, "/users/", handler)
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com"+c.target, strings.NewReader("hello"))
+		req.Header.Set("Referer", "https://example.com/from")
+		req.Header.Set("User-Agent", "test-agent")
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+
+		logs := observed.TakeAll()
+		if len(logs) != 1 {
+			t.Fatalf("Failed %s: expected 1 log, got %d", c.name, len(logs))
+		}
+		if logs[0].Level != c.wantLevel {
+			t.Errorf("Failed %s: expected level %s, got %s", c.name, c.wantLevel, logs[0].Level)
+		}
+		fields := logs[0].ContextMap()
+		for key, want := range c.want {
+			if fields[key] != want {
+				t.Errorf("Failed %s: expected %s %v, got %v", c.name, key, want, fields[key])
+			}
+		}
+		for _, key := range c.omitted {
+			if _, ok := fields[key]; ok {
+				t.Errorf("Failed %s: expected %s to be omitted", c.name, key)
+			}
+		}
+		if duration, ok := fields["duration"].(float64); !ok || duration <= 0 {
+			t.Errorf("Failed %s: expected a positive duration, got %v", c.name, fields["duration"])
+		}
+		if _, ok := fields["start"].(time.Time); !ok {
+			t.Errorf("Failed %s: expected a start time, got %v", c.name, fields["start"])
+		}
+	}
+}
+
+func TestLoggingLevels(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	})
+	debugLevel := func(int) zapcore.Level { return zapcore.DebugLevel }
+
+	cases := []struct {
+		name        string
+		opts        LoggingOptions
+		target      string
+		wantLogged  bool
+		wantLevel   zapcore.Level
+		wantMessage string
+	}{
+		{"Logging logs 2xx at Info", LoggingOptions{}, "/?status=200", true, zapcore.InfoLevel, "HTTP request"},
+		{"Logging logs 4xx at Warn", LoggingOptions{}, "/?status=404", true, zapcore.WarnLevel, "HTTP request"},
+		{"Logging logs 5xx at Error", LoggingOptions{}, "/?status=502", true, zapcore.ErrorLevel, "HTTP request"},
+		{"Logging uses the configured level", LoggingOptions{Level: debugLevel}, "/?status=500", true, zapcore.DebugLevel, "HTTP request"},
+		{"Logging uses the configured message", LoggingOptions{Message: "served"}, "/?status=200", true, zapcore.InfoLevel, "served"},
+		{"Logging skips paths", LoggingOptions{SkipPaths: []string{"/live", "/ready"}}, "/ready?status=200", false, 0, ""},
+		{"Logging only skips exact paths", LoggingOptions{SkipPaths: []string{"/live"}}, "/lively?status=200", true, zapcore.InfoLevel, "HTTP request"},
+	}
+	for _, c := range cases {
+		LoggingWithOptions(c.opts)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, c.target, nil))
+
+		logs := observed.TakeAll()
+		if !c.wantLogged {
+			if len(logs) != 0 {
+				t.Errorf("Failed %s: expected no logs, got %d", c.name, len(logs))
+			}
+			continue
+		}
+		if len(logs) != 1 {
+			t.Fatalf("Failed %s: expected 1 log, got %d", c.name, len(logs))
+		}
+		if logs[0].Level != c.wantLevel {
+			t.Errorf("Failed %s: expected level %s, got %s", c.name, c.wantLevel, logs[0].Level)
+		}
+		if logs[0].Message != c.wantMessage {
+			t.Errorf("Failed %s: expected message %q, got %q", c.name, c.wantMessage, logs[0].Message)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package middlewares
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.uber.org/zap"
+)
+
+// RateLimitAlgorithm selects how a RateLimiter counts requests
+type RateLimitAlgorithm int
+
+const (
+	// TokenBucket allows bursts of up to Limit requests, refilling at a rate of
+	// Limit requests per Period
+	TokenBucket RateLimitAlgorithm = iota
+	// SlidingWindow allows Limit requests in any Period, approximated by
+	// weighting the previous fixed window's count against the current one
+	SlidingWindow
+)
+
+// RateLimitPolicy describes a rate limit
+type RateLimitPolicy struct {
+	Algorithm RateLimitAlgorithm
+	Limit     int
+	Period    time.Duration
+}
+
+// validate returns an error if p can't be enforced
+func (p RateLimitPolicy) validate() error {
+	if p.Algorithm != TokenBucket && p.Algorithm != SlidingWindow {
+		return fmt.Errorf("unknown rate limit algorithm %d", p.Algorithm)
+	}
+	if p.Limit <= 0 {
+		return fmt.Errorf("rate limit must be positive, got %d", p.Limit)
+	}
+	if p.Period < time.Millisecond {
+		return fmt.Errorf("rate limit period must be at least 1ms, got %s", p.Period)
+	}
+	return nil
+}
+
+// RateLimitResult is the outcome of a single RateLimiter.Allow call
+type RateLimitResult struct {
+	// Allowed reports whether the request may proceed
+	Allowed bool
+	// Limit is the policy's request limit
+	Limit int
+	// Remaining is the number of requests that may still be made
+	Remaining int
+	// Reset is the time until the limit is fully replenished
+	Reset time.Duration
+	// RetryAfter is the time until the next request will be allowed. It is
+	// only set when Allowed is false.
+	RetryAfter time.Duration
+}
+
+// RateLimiter counts requests against a limit per key
+type RateLimiter interface {
+	Allow(key string) (RateLimitResult, error)
+}
+
+// RateLimitKeyFunc derives a rate limit key from a request. Returning an error
+// skips rate limiting for the request.
+type RateLimitKeyFunc func(*http.Request) (string, error)
+
+// RateLimitByOrg keys rate limits by the org ID stored in the request context
+func RateLimitByOrg(r *http.Request) (string, error) {
+	orgID, err := OrgIDFromContext(r.Context())
+	if err != nil {
+		return "", err
+	}
+	return "org:" + orgID, nil
+}
+
+// RateLimitByUser keys rate limits by the user ID stored in the request context
+func RateLimitByUser(r *http.Request) (string, error) {
+	userID, err := UserIDFromContext(r.Context())
+	if err != nil {
+		return "", err
+	}
+	return "user:" + userID, nil
+}
+
+// RateLimitByIP keys rate limits by the client's IP address, as resolved by
+// the ClientIP middleware
+func RateLimitByIP(r *http.Request) (string, error) {
+	ip := getRemoteAddr(r)
+	if ip == "" {
+		return "", errors.New("Remote address is not available")
+	}
+	return "ip:" + ip, nil
+}
+
+// RateLimit is a middleware that limits requests per key using limiter. Every
+// response carries RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers. Requests over the limit receive a 429 with a Retry-After header,
+// and the following metric is added:
+//
+//	# Counter
+//	http_request_rate_limited{"sha", "method", "path"}
+//
+// If the limiter returns an error, the request is allowed and the error is
+// logged.
+func RateLimit(limiter RateLimiter, keyFunc RateLimitKeyFunc) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := keyFunc(r)
+			if err != nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := limiter.Allow(key)
+			if err != nil {
+				zap.L().Error("Error checking rate limit", zap.String("key", key), zap.Error(err))
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+			if !result.Allowed {
+				if statsdClient := Client(); statsdClient != nil {
+					statsdClient.Incr("http_request_rate_limited", requestTags(r.Method, r.URL.Path), 1)
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte(`{"error": "rate limit exceeded"}`))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// tokenBucketResult builds a RateLimitResult from the tokens left in a bucket
+// after a request was (or was not) taken from it
+func tokenBucketResult(p RateLimitPolicy, allowed bool, tokens float64) RateLimitResult {
+	perToken := float64(p.Period) / float64(p.Limit)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(p.Limit) - tokens) * perToken),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * perToken)
+	}
+	return result
+}
+
+// slidingWindowCount returns the weighted request count across the current
+// and previous windows
+func slidingWindowCount(p RateLimitPolicy, current, previous int64, now time.Time) float64 {
+	elapsed := now.UnixNano() % int64(p.Period)
+	weight := 1 - float64(elapsed)/float64(p.Period)
+	return float64(previous)*weight + float64(current)
+}
+
+// slidingWindowResult builds a RateLimitResult from the request counts of the
+// current and previous windows, including the current request if allowed
+func slidingWindowResult(p RateLimitPolicy, allowed bool, current, previous int64, now time.Time) RateLimitResult {
+	elapsed := time.Duration(now.UnixNano() % int64(p.Period))
+	count := slidingWindowCount(p, current, previous, now)
+
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     p.Limit,
+		Remaining: int(math.Max(0, math.Floor(float64(p.Limit)-count))),
+	}
+	switch {
+	case current > 0:
+		result.Reset = 2*p.Period - elapsed
+	case previous > 0:
+		result.Reset = p.Period - elapsed
+	}
+	if !allowed {
+		// Wait for the previous window's weight to drop enough to admit one
+		// more request, or for the current window to end
+		result.RetryAfter = p.Period - elapsed
+		if previous > 0 && current < int64(p.Limit) {
+			needed := time.Duration(float64(p.Period) * (1 - float64(int64(p.Limit)-current)/float64(previous)))
+			if needed > elapsed && needed-elapsed < result.RetryAfter {
+				result.RetryAfter = needed - elapsed
+			}
+		}
+	}
+	return result
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type memoryWindow struct {
+	window   int64
+	current  int64
+	previous int64
+}
+
+// MemoryRateLimiter is a RateLimiter that keeps counts in process memory. It
+// is suitable for services running a single instance.
+type MemoryRateLimiter struct {
+	policy    RateLimitPolicy
+	now       func() time.Time
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	windows   map[string]*memoryWindow
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimiter returns a MemoryRateLimiter enforcing policy. It panics
+// if policy doesn't have a positive Limit and a Period of at least 1ms.
+func NewMemoryRateLimiter(policy RateLimitPolicy) *MemoryRateLimiter {
+	if err := policy.validate(); err != nil {
+		panic("middlewares: " + err.Error())
+	}
+	return &MemoryRateLimiter{
+		policy:  policy,
+		now:     time.Now,
+		buckets: map[string]*memoryBucket{},
+		windows: map[string]*memoryWindow{},
+	}
+}
+
+// Allow satisfies the RateLimiter interface
+func (m *MemoryRateLimiter) Allow(key string) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	if m.policy.Algorithm == SlidingWindow {
+		window := now.UnixNano() / int64(m.policy.Period)
+		w, ok := m.windows[key]
+		if !ok {
+			w = &memoryWindow{window: window}
+			m.windows[key] = w
+		}
+		switch {
+		case w.window == window-1:
+			w.previous, w.current = w.current, 0
+		case w.window < window-1:
+			w.previous, w.current = 0, 0
+		}
+		w.window = window
+
+		allowed := slidingWindowCount(m.policy, w.current, w.previous, now) < float64(m.policy.Limit)
+		if allowed {
+			w.current++
+		}
+		return slidingWindowResult(m.policy, allowed, w.current, w.previous, now), nil
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(m.policy.Limit), last: now}
+		m.buckets[key] = b
+	}
+	elapsed := now.Sub(b.last)
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(m.policy.Limit), b.tokens+float64(elapsed)*float64(m.policy.Limit)/float64(m.policy.Period))
+	}
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return tokenBucketResult(m.policy, allowed, b.tokens), nil
+}
+
+// sweep removes state for keys that have been idle long enough to be fully
+// replenished. It runs at most once per Period.
+func (m *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.policy.Period {
+		return
+	}
+	m.lastSweep = now
+	for key, b := range m.buckets {
+		if now.Sub(b.last) > m.policy.Period {
+			delete(m.buckets, key)
+		}
+	}
+	window := now.UnixNano() / int64(m.policy.Period)
+	for key, w := range m.windows {
+		if w.window < window-1 {
+			delete(m.windows, key)
+		}
+	}
+}
+
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * capacity / period)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", ts)
+redis.call("PEXPIRE", KEYS[1], period)
+return {allowed, tostring(tokens)}
+`)
+
+var slidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local weight = tonumber(ARGV[3])
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+local allowed = 0
+if previous * weight + current < limit then
+	current = redis.call("INCR", KEYS[1])
+	redis.call("PEXPIRE", KEYS[1], period * 2)
+	allowed = 1
+end
+return {allowed, current, previous}
+`)
+
+// RedisRateLimiter is a RateLimiter that keeps counts in Redis, so limits are
+// shared by every instance of a service. Each check is a single Lua script
+// call. Timestamps come from the calling instance, so instance clocks should
+// be kept in sync.
+type RedisRateLimiter struct {
+	policy RateLimitPolicy
+	client redis.Cmdable
+	prefix string
+	now    func() time.Time
+}
+
+// NewRedisRateLimiter returns a RedisRateLimiter enforcing policy. Keys are
+// stored under "ratelimit:". The client is usually cache.GetConnection(). It
+// panics if policy doesn't have a positive Limit and a Period of at least 1ms.
+func NewRedisRateLimiter(client redis.Cmdable, policy RateLimitPolicy) *RedisRateLimiter {
+	if err := policy.validate(); err != nil {
+		panic("middlewares: " + err.Error())
+	}
+	return &RedisRateLimiter{
+		policy: policy,
+		client: client,
+		prefix: "ratelimit:",
+		now:    time.Now,
+	}
+}
+
+// Allow satisfies the RateLimiter interface
+func (l *RedisRateLimiter) Allow(key string) (RateLimitResult, error) {
+	now := l.now()
+	periodMs := int64(l.policy.Period / time.Millisecond)
+
+	if l.policy.Algorithm == SlidingWindow {
+		window := now.UnixNano() / int64(l.policy.Period)
+		weight := slidingWindowCount(l.policy, 0, 1, now)
+		keys := []string{
+			l.prefix + key + ":" + strconv.FormatInt(window, 10),
+			l.prefix + key + ":" + strconv.FormatInt(window-1, 10),
+		}
+		values, err := slidingWindowScript.Run(l.client, keys, l.policy.Limit, periodMs, weight).Result()
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		v, ok := values.([]interface{})
+		if !ok || len(v) != 3 {
+			return RateLimitResult{}, errors.New("Unexpected sliding window script result")
+		}
+		allowed, _ := v[0].(int64)
+		current, _ := v[1].(int64)
+		previous, _ := v[2].(int64)
+		return slidingWindowResult(l.policy, allowed == 1, current, previous, now), nil
+	}
+
+	nowMs := now.UnixNano() / int64(time.Millisecond)
+	values, err := tokenBucketScript.Run(l.client, []string{l.prefix + key}, l.policy.Limit, periodMs, nowMs).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	v, ok := values.([]interface{})
+	if !ok || len(v) != 2 {
+		return RateLimitResult{}, errors.New("Unexpected token bucket script result")
+	}
+	allowed, _ := v[0].(int64)
+	tokensString, _ := v[1].(string)
+	tokens, err := strconv.ParseFloat(tokensString, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return tokenBucketResult(l.policy, allowed == 1, tokens), nil
+}
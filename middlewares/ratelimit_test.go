@@ -0,0 +1,150 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	start := time.Unix(1599999960, 0)
+
+	cases := []struct {
+		name      string
+		policy    RateLimitPolicy
+		offsets   []time.Duration
+		wantAllow []bool
+	}{
+		{
+			"TokenBucket allows a burst up to the limit",
+			RateLimitPolicy{TokenBucket, 3, time.Minute},
+			[]time.Duration{0, 0, 0, 0},
+			[]bool{true, true, true, false},
+		},
+		{
+			"TokenBucket refills over time",
+			RateLimitPolicy{TokenBucket, 2, time.Minute},
+			[]time.Duration{0, 0, 0, 30 * time.Second, 30 * time.Second},
+			[]bool{true, true, false, true, false},
+		},
+		{
+			"SlidingWindow allows the limit within a window",
+			RateLimitPolicy{SlidingWindow, 2, time.Minute},
+			[]time.Duration{0, time.Second, 2 * time.Second},
+			[]bool{true, true, false},
+		},
+		{
+			"SlidingWindow weights the previous window",
+			RateLimitPolicy{SlidingWindow, 3, time.Minute},
+			[]time.Duration{0, 0, 0, 75 * time.Second, 80 * time.Second, 110 * time.Second},
+			[]bool{true, true, true, true, false, true},
+		},
+	}
+	for _, c := range cases {
+		limiter := NewMemoryRateLimiter(c.policy)
+		for i, offset := range c.offsets {
+			limiter.now = func() time.Time { return start.Add(offset) }
+			result, err := limiter.Allow("key")
+			if err != nil {
+				t.Fatalf("Failed %s: Unexpected error: %v", c.name, err)
+			}
+			if result.Allowed != c.wantAllow[i] {
+				t.Errorf("Failed %s: request %d Expected allowed: %v, got: %v", c.name, i, c.wantAllow[i], result.Allowed)
+			}
+			if !result.Allowed && result.RetryAfter <= 0 {
+				t.Errorf("Failed %s: request %d Expected a positive RetryAfter", c.name, i)
+			}
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := NewMemoryRateLimiter(RateLimitPolicy{TokenBucket, 1, time.Minute})
+	handler := RateLimit(limiter, RateLimitByOrg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	cases := []struct {
+		name           string
+		orgID          string
+		wantStatus     int
+		wantRemaining  string
+		wantRetryAfter string
+	}{
+		{"RateLimit allows the first request", "org1", http.StatusOK, "0", ""},
+		{"RateLimit rejects the second request", "org1", http.StatusTooManyRequests, "0", "60"},
+		{"RateLimit keys by org", "org2", http.StatusOK, "0", ""},
+		{"RateLimit skips requests without a key", "", http.StatusOK, "", ""},
+	}
+	for _, c := range cases {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.orgID != "" {
+			request = request.WithContext(ContextWithUser(context.Background(), "user", c.orgID, false))
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		if got := recorder.Header().Get("RateLimit-Remaining"); got != c.wantRemaining {
+			t.Errorf("Failed %s: RateLimit-Remaining Expected: %q, got: %q", c.name, c.wantRemaining, got)
+		}
+		if got := recorder.Header().Get("Retry-After"); got != c.wantRetryAfter {
+			t.Errorf("Failed %s: Retry-After Expected: %q, got: %q", c.name, c.wantRetryAfter, got)
+		}
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer client.Close()
+	if err := client.Ping().Err(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+
+	for _, algorithm := range []RateLimitAlgorithm{TokenBucket, SlidingWindow} {
+		limiter := NewRedisRateLimiter(client, RateLimitPolicy{algorithm, 2, time.Minute})
+		key := "test:" + time.Now().String()
+		for i, want := range []bool{true, true, false} {
+			result, err := limiter.Allow(key)
+			if err != nil {
+				t.Fatalf("Failed algorithm %d: Unexpected error: %v", algorithm, err)
+			}
+			if result.Allowed != want {
+				t.Errorf("Failed algorithm %d: request %d Expected allowed: %v, got: %v", algorithm, i, want, result.Allowed)
+			}
+		}
+	}
+}
+
+func TestRateLimitPolicyValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy RateLimitPolicy
+		valid  bool
+	}{
+		{"Policies with a limit and period are valid", RateLimitPolicy{Algorithm: SlidingWindow, Limit: 10, Period: time.Second}, true},
+		{"Policies need a period", RateLimitPolicy{Limit: 10}, false},
+		{"Policies need a period of at least 1ms", RateLimitPolicy{Limit: 10, Period: time.Microsecond}, false},
+		{"Policies need a limit", RateLimitPolicy{Period: time.Second}, false},
+		{"Policies need a known algorithm", RateLimitPolicy{Algorithm: 5, Limit: 10, Period: time.Second}, false},
+	}
+	for _, c := range cases {
+		for _, construct := range []func(RateLimitPolicy){
+			func(p RateLimitPolicy) { NewMemoryRateLimiter(p) },
+			func(p RateLimitPolicy) { NewRedisRateLimiter(nil, p) },
+		} {
+			func() {
+				defer func() {
+					if panicked := recover() != nil; panicked == c.valid {
+						t.Errorf("Failed %s: panicked: %v", c.name, panicked)
+					}
+				}()
+				construct(c.policy)
+			}()
+		}
+	}
+}
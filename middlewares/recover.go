@@ -0,0 +1,70 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// DefaultPanicBody is the response body written by Recover when a handler panics
+const DefaultPanicBody = `{"error": "internal server error"}`
+
+// Recover is a middleware that recovers from panics in the wrapped handler and
+// responds with a 500 and DefaultPanicBody. See RecoverWithBody.
+func Recover() Middleware {
+	return RecoverWithBody(DefaultPanicBody)
+}
+
+// RecoverWithBody is a middleware that recovers from panics in the wrapped
+// handler. The panic is logged at error level with a stacktrace, the request
+// ID and user fields from the request context, and the following metric is
+// added:
+//
+//	# Counter
+//	http_request_panic{"sha", "method", "path"}
+//
+// If the handler has not yet written a response, a 500 is returned with the
+// given JSON body. Otherwise the response is aborted with
+// http.ErrAbortHandler, so the client sees a broken connection rather than a
+// truncated response that looks complete. Panics with http.ErrAbortHandler are
+// re-raised so that net/http can abort the response as intended.
+func RecoverWithBody(body string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wrappedWriter := WrapResponseWriter(w)
+
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+
+				fields := []zap.Field{
+					zap.String("panic", fmt.Sprint(rec)),
+					zap.String("path", r.URL.Path),
+					zap.String("method", r.Method),
+					zap.Stack("stacktrace"),
+				}
+				fields = append(fields, contextFields(r.Context())...)
+				zap.L().Error("Recovered from panic", fields...)
+
+				if statsdClient := Client(); statsdClient != nil {
+					statsdClient.Incr("http_request_panic", requestTags(r.Method, r.URL.Path), 1)
+				}
+
+				if wrappedWriter.WroteHeader() {
+					panic(http.ErrAbortHandler)
+				}
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(body))
+			}()
+
+			h.ServeHTTP(wrappedWriter, r)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRecover(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	cases := []struct {
+		name       string
+		middleware Middleware
+		handler    http.HandlerFunc
+		wantStatus int
+		wantBody   string
+		wantLogs   int
+		wantAbort  bool
+	}{
+		{
+			"Recover returns the default body on panic",
+			Recover(),
+			func(w http.ResponseWriter, r *http.Request) {
+				panic("oh no")
+			},
+			http.StatusInternalServerError,
+			DefaultPanicBody,
+			1,
+			false,
+		},
+		{
+			"RecoverWithBody returns the configured body on panic",
+			RecoverWithBody(`{"message": "try again"}`),
+			func(w http.ResponseWriter, r *http.Request) {
+				panic("oh no")
+			},
+			http.StatusInternalServerError,
+			`{"message": "try again"}`,
+			1,
+			false,
+		},
+		{
+			"Recover aborts a response that was already started",
+			Recover(),
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("partial"))
+				panic("oh no")
+			},
+			http.StatusAccepted,
+			"partial",
+			1,
+			true,
+		},
+		{
+			"Recover passes through when there is no panic",
+			Recover(),
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			},
+			http.StatusOK,
+			"ok",
+			0,
+			false,
+		},
+	}
+	for _, c := range cases {
+		observed.TakeAll()
+		handler := c.middleware(c.handler)
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request = request.WithContext(ContextWithRequestID(request.Context(), "abc-123"))
+		recorder := httptest.NewRecorder()
+		func() {
+			defer func() {
+				if aborted := recover() == http.ErrAbortHandler; aborted != c.wantAbort {
+					t.Errorf("Failed %s: aborted Expected: %v, got: %v", c.name, c.wantAbort, aborted)
+				}
+			}()
+			handler.ServeHTTP(recorder, request)
+		}()
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		if got := recorder.Body.String(); got != c.wantBody {
+			t.Errorf("Failed %s: body Expected: %q, got: %q", c.name, c.wantBody, got)
+		}
+		logs := observed.TakeAll()
+		if len(logs) != c.wantLogs {
+			t.Fatalf("Failed %s: Expected %d logs, got %d", c.name, c.wantLogs, len(logs))
+		}
+		if c.wantLogs == 0 {
+			continue
+		}
+		fields := logs[0].ContextMap()
+		if fields["requestId"] != "abc-123" {
+			t.Errorf("Failed %s: Expected requestId field, got: %v", c.name, fields["requestId"])
+		}
+		if fields["stacktrace"] == "" || fields["stacktrace"] == nil {
+			t.Errorf("Failed %s: Expected stacktrace field", c.name)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package middlewares
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// ResponseWriter is an http.ResponseWriter that records the status code and
+// the number of body bytes written by the wrapped handler. It is shared by
+// all middlewares in this package that need to observe a response.
+type ResponseWriter interface {
+	http.ResponseWriter
+	// Status returns the status code sent to the client, or http.StatusOK if
+	// the handler has not called WriteHeader.
+	Status() int
+	// BytesWritten returns the number of body bytes written to the client.
+	BytesWritten() int
+	// WroteHeader reports whether the response headers have been sent.
+	WroteHeader() bool
+	// Unwrap returns the underlying http.ResponseWriter. It is used by
+	// http.ResponseController.
+	Unwrap() http.ResponseWriter
+}
+
+// WrapResponseWriter wraps w in a ResponseWriter. The returned value
+// implements exactly the optional interfaces (http.Flusher, http.Hijacker,
+// http.Pusher and io.ReaderFrom) that w implements, so wrapping a handler
+// doesn't break server-sent events, websockets, HTTP/2 push or sendfile.
+func WrapResponseWriter(w http.ResponseWriter) ResponseWriter {
+	return wrapResponseWriter(w, nil)
+}
+
+// wrapResponseWriter is WrapResponseWriter, also copying the body written to
+// tee if it is set
+func wrapResponseWriter(w http.ResponseWriter, tee io.Writer) ResponseWriter {
+	rw := &statusLoggingResponseWriter{ResponseWriter: w, status: http.StatusOK, tee: tee}
+
+	_, isFlusher := w.(http.Flusher)
+	_, isHijacker := w.(http.Hijacker)
+	_, isPusher := w.(http.Pusher)
+	_, isReaderFrom := w.(io.ReaderFrom)
+
+	f := flusher{rw}
+	h := hijacker{rw}
+	p := pusher{rw}
+	rf := readerFrom{rw}
+
+	switch {
+	case !isFlusher && !isHijacker && !isPusher && !isReaderFrom:
+		return rw
+	case isFlusher && !isHijacker && !isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+		}{rw, f}
+	case !isFlusher && isHijacker && !isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+		}{rw, h}
+	case isFlusher && isHijacker && !isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{rw, f, h}
+	case !isFlusher && !isHijacker && isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Pusher
+		}{rw, p}
+	case isFlusher && !isHijacker && isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{rw, f, p}
+	case !isFlusher && isHijacker && isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{rw, h, p}
+	case isFlusher && isHijacker && isPusher && !isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{rw, f, h, p}
+	case !isFlusher && !isHijacker && !isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			io.ReaderFrom
+		}{rw, rf}
+	case isFlusher && !isHijacker && !isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{rw, f, rf}
+	case !isFlusher && isHijacker && !isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, h, rf}
+	case isFlusher && isHijacker && !isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, f, h, rf}
+	case !isFlusher && !isHijacker && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Pusher
+			io.ReaderFrom
+		}{rw, p, rf}
+	case isFlusher && !isHijacker && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, p, rf}
+	case !isFlusher && isHijacker && isPusher && isReaderFrom:
+		return struct {
+			ResponseWriter
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, h, p, rf}
+	default:
+		return struct {
+			ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, f, h, p, rf}
+	}
+}
+
+type statusLoggingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bodyBytes   int
+	wroteHeader bool
+	tee         io.Writer
+}
+
+func (w *statusLoggingResponseWriter) Status() int {
+	return w.status
+}
+
+func (w *statusLoggingResponseWriter) BytesWritten() int {
+	return w.bodyBytes
+}
+
+func (w *statusLoggingResponseWriter) WroteHeader() bool {
+	return w.wroteHeader
+}
+
+func (w *statusLoggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// WriteHeader records the first final status code written. Informational
+// (1xx) responses other than 101 Switching Protocols may precede the final
+// status and are passed through without being recorded.
+func (w *statusLoggingResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusLoggingResponseWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	length, err := w.ResponseWriter.Write(data)
+	w.bodyBytes += length
+	if w.tee != nil {
+		w.tee.Write(data[:length])
+	}
+	return length, err
+}
+
+type flusher struct {
+	w *statusLoggingResponseWriter
+}
+
+func (f flusher) Flush() {
+	f.w.wroteHeader = true
+	f.w.ResponseWriter.(http.Flusher).Flush()
+}
+
+type hijacker struct {
+	w *statusLoggingResponseWriter
+}
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := h.w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && !h.w.wroteHeader {
+		h.w.status = http.StatusSwitchingProtocols
+		h.w.wroteHeader = true
+	}
+	return conn, brw, err
+}
+
+type pusher struct {
+	w *statusLoggingResponseWriter
+}
+
+func (p pusher) Push(target string, opts *http.PushOptions) error {
+	return p.w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
+
+type readerFrom struct {
+	w *statusLoggingResponseWriter
+}
+
+func (rf readerFrom) ReadFrom(src io.Reader) (int64, error) {
+	rf.w.wroteHeader = true
+	if rf.w.tee != nil {
+		src = io.TeeReader(src, rf.w.tee)
+	}
+	n, err := rf.w.ResponseWriter.(io.ReaderFrom).ReadFrom(src)
+	rf.w.bodyBytes += int(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package middlewares
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (h hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+type plainWriter struct {
+	header http.Header
+}
+
+func (p *plainWriter) Header() http.Header         { return p.header }
+func (p *plainWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (p *plainWriter) WriteHeader(int)             {}
+
+func TestWrapResponseWriterInterfaces(t *testing.T) {
+	cases := []struct {
+		name         string
+		writer       http.ResponseWriter
+		wantFlusher  bool
+		wantHijacker bool
+		wantPusher   bool
+	}{
+		{
+			"WrapResponseWriter exposes no optional interfaces on a plain writer",
+			&plainWriter{http.Header{}},
+			false,
+			false,
+			false,
+		},
+		{
+			"WrapResponseWriter exposes Flusher",
+			httptest.NewRecorder(),
+			true,
+			false,
+			false,
+		},
+		{
+			"WrapResponseWriter exposes Flusher and Hijacker",
+			hijackableRecorder{httptest.NewRecorder()},
+			true,
+			true,
+			false,
+		},
+	}
+	for _, c := range cases {
+		w := WrapResponseWriter(c.writer)
+		if _, ok := w.(http.Flusher); ok != c.wantFlusher {
+			t.Errorf("Failed %s: http.Flusher Expected: %v, got: %v", c.name, c.wantFlusher, ok)
+		}
+		if _, ok := w.(http.Hijacker); ok != c.wantHijacker {
+			t.Errorf("Failed %s: http.Hijacker Expected: %v, got: %v", c.name, c.wantHijacker, ok)
+		}
+		if _, ok := w.(http.Pusher); ok != c.wantPusher {
+			t.Errorf("Failed %s: http.Pusher Expected: %v, got: %v", c.name, c.wantPusher, ok)
+		}
+		if w.Unwrap() != c.writer {
+			t.Errorf("Failed %s: Unwrap() did not return the underlying writer", c.name)
+		}
+	}
+}
+
+func TestWrapResponseWriterStatus(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	w := WrapResponseWriter(recorder)
+	if w.Status() != http.StatusOK {
+		t.Errorf("Expected default status %d, got %d", http.StatusOK, w.Status())
+	}
+
+	w.WriteHeader(http.StatusTeapot)
+	w.WriteHeader(http.StatusInternalServerError)
+	io.Copy(w, strings.NewReader("hello"))
+
+	if w.Status() != http.StatusTeapot {
+		t.Errorf("Expected first final status %d, got %d", http.StatusTeapot, w.Status())
+	}
+	if w.BytesWritten() != 5 {
+		t.Errorf("Expected 5 body bytes, got %d", w.BytesWritten())
+	}
+}
+
+func TestLoggingPreservesFlusher(t *testing.T) {
+	handler := Apply(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("Expected wrapped writer to flush, got: %v", err)
+			}
+		}),
+		Logging(),
+		InstrumentRoute(),
+	)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
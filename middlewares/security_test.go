@@ -0,0 +1,75 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	cases := []struct {
+		name        string
+		policy      SecurityPolicy
+		wantHeaders map[string]string
+	}{
+		{
+			"SecurityHeaders applies the API preset",
+			APISecurityPolicy(),
+			map[string]string{
+				"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+				"Content-Security-Policy":   "default-src 'none'; frame-ancestors 'none'",
+				"X-Content-Type-Options":    "nosniff",
+				"Referrer-Policy":           "no-referrer",
+				"X-Frame-Options":           "DENY",
+				"Permissions-Policy":        "",
+			},
+		},
+		{
+			"SecurityHeaders omits empty fields",
+			SecurityPolicy{FrameOptions: "SAMEORIGIN"},
+			map[string]string{
+				"Strict-Transport-Security": "",
+				"Content-Security-Policy":   "",
+				"X-Content-Type-Options":    "",
+				"X-Frame-Options":           "SAMEORIGIN",
+			},
+		},
+	}
+	for _, c := range cases {
+		handler := SecurityHeaders(c.policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		for header, want := range c.wantHeaders {
+			if got := recorder.Header().Get(header); got != want {
+				t.Errorf("Failed %s: %s Expected: %q, got: %q", c.name, header, want, got)
+			}
+		}
+	}
+}
+
+func TestSecurityHeadersNonce(t *testing.T) {
+	var nonces []string
+	handler := SecurityHeaders(HTMLSecurityPolicy())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := CSPNonceFromContext(r.Context())
+		if err != nil {
+			t.Fatalf("Expected nonce in context, got: %v", err)
+		}
+		nonces = append(nonces, nonce)
+	}))
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+		csp := recorder.Header().Get("Content-Security-Policy")
+		if !strings.Contains(csp, "'nonce-"+nonces[i]+"'") {
+			t.Errorf("Expected CSP to contain nonce %q, got: %q", nonces[i], csp)
+		}
+		if strings.Contains(csp, CSPNoncePlaceholder) {
+			t.Errorf("Expected placeholder to be replaced, got: %q", csp)
+		}
+	}
+	if nonces[0] == nonces[1] {
+		t.Errorf("Expected a new nonce per request, got %q twice", nonces[0])
+	}
+}
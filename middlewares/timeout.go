@@ -0,0 +1,211 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RequestTimeoutHeader is the header clients can use to request a shorter or
+// longer timeout than a route's default
+const RequestTimeoutHeader = "X-Request-Timeout"
+
+// TimeoutOptions configures the Timeout middleware
+type TimeoutOptions struct {
+	// Timeout is the default time a handler may run for. It must be
+	// positive.
+	Timeout time.Duration
+	// MaxTimeout caps timeouts requested with the X-Request-Timeout header.
+	// Zero ignores the header.
+	MaxTimeout time.Duration
+	// StatusCode is returned when a handler times out. Defaults to 503.
+	StatusCode int
+	// Body is the JSON body returned when a handler times out
+	Body string
+}
+
+// requestTimeout parses an X-Request-Timeout header value, either a Go
+// duration ("1.5s", "500ms") or a whole number of seconds
+func requestTimeout(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, seconds > 0
+	}
+	d, err := time.ParseDuration(value)
+	return d, err == nil && d > 0
+}
+
+// Timeout is a middleware that bounds how long the wrapped handler may run by
+// setting a deadline on the request context. Clients may override the default
+// with the X-Request-Timeout header, capped at MaxTimeout. If the deadline
+// passes before the handler returns, the client receives StatusCode and Body,
+// the request log is marked with a timeout field, and the following metric is
+// added:
+//
+//	# Counter
+//	http_request_timeout{"sha", "method", "path"}
+//
+// The handler's response is buffered so it can't race the timeout response;
+// writes after the deadline return http.ErrHandlerTimeout. Because of the
+// buffering, handlers that stream responses should not be wrapped. If the
+// client cancels the request first, nothing is written.
+//
+// A handler panic before the timeout is logged with its stack and re-raised
+// on the request goroutine, for Recover to handle. A panic after the timeout
+// response is sent can't be re-raised, so it is only logged. Timeout panics if
+// opts.Timeout is not positive.
+func Timeout(opts TimeoutOptions) Middleware {
+	if opts.Timeout <= 0 {
+		panic("middlewares: Timeout requires a positive TimeoutOptions.Timeout")
+	}
+	if opts.StatusCode == 0 {
+		opts.StatusCode = http.StatusServiceUnavailable
+	}
+	if opts.Body == "" {
+		opts.Body = `{"error": "request timed out"}`
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := opts.Timeout
+			if requested, ok := requestTimeout(r.Header.Get(RequestTimeoutHeader)); ok && opts.MaxTimeout > 0 {
+				timeout = requested
+				if timeout > opts.MaxTimeout {
+					timeout = opts.MaxTimeout
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{header: make(http.Header), status: http.StatusOK}
+			done := make(chan struct{})
+			panicChan := make(chan handlerPanic, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						// The stack is only available here, in the panicking
+						// goroutine
+						hp := handlerPanic{value: p, stack: zap.Stack("stacktrace")}
+						tw.mu.Lock()
+						defer tw.mu.Unlock()
+						if !tw.timedOut {
+							panicChan <- hp
+							return
+						}
+						// Nothing is waiting for the panic once the timeout
+						// response is sent
+						if p != http.ErrAbortHandler {
+							zap.L().Error("Handler panicked after timing out", hp.fields(r)...)
+						}
+					}
+				}()
+				h.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case hp := <-panicChan:
+				hp.repanic(r)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				dst := w.Header()
+				for k, v := range tw.header {
+					dst[k] = v
+				}
+				w.WriteHeader(tw.status)
+				w.Write(tw.body.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				select {
+				case hp := <-panicChan:
+					// The handler panicked before the deadline was handled
+					hp.repanic(r)
+				default:
+				}
+				tw.timedOut = true
+
+				if ctx.Err() == context.Canceled {
+					// The client has gone, so there is no one to respond to
+					return
+				}
+				AddLogFields(r.Context(), zap.Bool("timeout", true), zap.Duration("timeout_after", timeout))
+				if statsdClient := Client(); statsdClient != nil {
+					statsdClient.Incr("http_request_timeout", requestTags(r.Method, r.URL.Path), 1)
+				}
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(opts.StatusCode)
+				w.Write([]byte(opts.Body))
+			}
+		})
+	}
+}
+
+// handlerPanic is a panic recovered from the handler goroutine, with its stack
+type handlerPanic struct {
+	value interface{}
+	stack zap.Field
+}
+
+func (hp handlerPanic) fields(r *http.Request) []zap.Field {
+	fields := []zap.Field{
+		zap.String("panic", fmt.Sprint(hp.value)),
+		zap.String("path", r.URL.Path),
+		zap.String("method", r.Method),
+		hp.stack,
+	}
+	return append(fields, contextFields(r.Context())...)
+}
+
+// repanic raises the panic on the request goroutine, so it reaches Recover
+// and net/http. The stack it was raised with is logged first, since the new
+// panic's stack only reaches Timeout.
+func (hp handlerPanic) repanic(r *http.Request) {
+	if hp.value != http.ErrAbortHandler {
+		zap.L().Error("Handler panicked in Timeout", hp.fields(r)...)
+	}
+	panic(hp.value)
+}
+
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	return tw.body.Write(data)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader || code < 200 {
+		return
+	}
+	tw.wroteHeader = true
+	tw.status = code
+}
@@ -0,0 +1,209 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTimeout(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	// The handler waits for the request deadline, or returns after 50ms
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			w.Write([]byte("too late"))
+		case <-time.After(50 * time.Millisecond):
+			w.Header().Set("X-Handled", "true")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("done"))
+		}
+	}
+
+	cases := []struct {
+		name        string
+		opts        TimeoutOptions
+		header      string
+		wantStatus  int
+		wantBody    string
+		wantTimeout bool
+	}{
+		{
+			"Timeout passes through a fast handler",
+			TimeoutOptions{Timeout: time.Second},
+			"",
+			http.StatusCreated,
+			"done",
+			false,
+		},
+		{
+			"Timeout stops a slow handler",
+			TimeoutOptions{Timeout: 10 * time.Millisecond},
+			"",
+			http.StatusServiceUnavailable,
+			`{"error": "request timed out"}`,
+			true,
+		},
+		{
+			"Timeout uses the configured status and body",
+			TimeoutOptions{Timeout: 10 * time.Millisecond, StatusCode: http.StatusGatewayTimeout, Body: `{"message": "slow"}`},
+			"",
+			http.StatusGatewayTimeout,
+			`{"message": "slow"}`,
+			true,
+		},
+		{
+			"Timeout honors the request header",
+			TimeoutOptions{Timeout: time.Second, MaxTimeout: time.Second},
+			"10ms",
+			http.StatusServiceUnavailable,
+			`{"error": "request timed out"}`,
+			true,
+		},
+		{
+			"Timeout caps the request header",
+			TimeoutOptions{Timeout: 10 * time.Millisecond, MaxTimeout: 20 * time.Millisecond},
+			"5",
+			http.StatusServiceUnavailable,
+			`{"error": "request timed out"}`,
+			true,
+		},
+		{
+			"Timeout ignores the request header without a max",
+			TimeoutOptions{Timeout: 10 * time.Millisecond},
+			"5",
+			http.StatusServiceUnavailable,
+			`{"error": "request timed out"}`,
+			true,
+		},
+	}
+	for _, c := range cases {
+		observed.TakeAll()
+		wrapped := Apply(http.HandlerFunc(handler), Timeout(c.opts), Logging())
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.header != "" {
+			request.Header.Set(RequestTimeoutHeader, c.header)
+		}
+		recorder := httptest.NewRecorder()
+		wrapped.ServeHTTP(recorder, request)
+
+		if recorder.Code != c.wantStatus {
+			t.Errorf("Failed %s: status Expected: %d, got: %d", c.name, c.wantStatus, recorder.Code)
+		}
+		if got := recorder.Body.String(); got != c.wantBody {
+			t.Errorf("Failed %s: body Expected: %q, got: %q", c.name, c.wantBody, got)
+		}
+		if !c.wantTimeout && recorder.Header().Get("X-Handled") != "true" {
+			t.Errorf("Failed %s: Expected handler headers to be copied", c.name)
+		}
+		logs := observed.TakeAll()
+		if len(logs) != 1 {
+			t.Fatalf("Failed %s: Expected 1 log, got %d", c.name, len(logs))
+		}
+		if got := logs[0].ContextMap()["timeout"] == true; got != c.wantTimeout {
+			t.Errorf("Failed %s: timeout field Expected: %v, got: %v", c.name, c.wantTimeout, got)
+		}
+	}
+}
+
+func panickingHandler(w http.ResponseWriter, r *http.Request) {
+	panic("oh no")
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	handler := Apply(
+		http.HandlerFunc(panickingHandler),
+		Timeout(TimeoutOptions{Timeout: time.Second}),
+		Recover(),
+	)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusInternalServerError {
+		t.Errorf("Expected panics to reach Recover, got status %d", recorder.Code)
+	}
+	logs := observed.FilterMessage("Handler panicked in Timeout").All()
+	if len(logs) != 1 {
+		t.Fatalf("Expected 1 panic log, got %d", len(logs))
+	}
+	if stack, _ := logs[0].ContextMap()["stacktrace"].(string); !strings.Contains(stack, "panickingHandler") {
+		t.Errorf("Expected the handler's stack to be logged, got %q", stack)
+	}
+}
+
+func TestTimeoutLatePanic(t *testing.T) {
+	core, observed := observer.New(zapcore.DebugLevel)
+	reset := zap.ReplaceGlobals(zap.New(core))
+	defer reset()
+
+	panicked := make(chan struct{})
+	handler := Timeout(TimeoutOptions{Timeout: 10 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(panicked)
+		<-r.Context().Done()
+		// Wait for the timeout response to be sent
+		for {
+			if _, err := w.Write(nil); err == http.ErrHandlerTimeout {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		panicLate()
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+
+	<-panicked
+	for i := 0; i < 100 && observed.FilterMessage("Handler panicked after timing out").Len() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	logs := observed.FilterMessage("Handler panicked after timing out").All()
+	if len(logs) != 1 {
+		t.Fatalf("Expected the late panic to be logged, got %d logs", len(logs))
+	}
+	if stack, _ := logs[0].ContextMap()["stacktrace"].(string); !strings.Contains(stack, "panicLate") {
+		t.Errorf("Expected the handler's stack to be logged, got %q", stack)
+	}
+}
+
+func panicLate() {
+	panic("too late")
+}
+
+func TestTimeoutClientCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	handler := Timeout(TimeoutOptions{Timeout: time.Second})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		<-r.Context().Done()
+		time.Sleep(10 * time.Millisecond)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if recorder.Body.Len() != 0 {
+		t.Errorf("Expected no response for a canceled request, got %q", recorder.Body.String())
+	}
+}
+
+func TestTimeoutRequiresTimeout(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected Timeout to panic without a positive timeout")
+		}
+	}()
+	Timeout(TimeoutOptions{})
+}